@@ -0,0 +1,410 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client talks to the ZStack API with one session. It is safe to share a
+// Client between the resource clients: the session is renewed transparently
+// when it expires.
+type Client struct {
+	accountName    string
+	password       string
+	serverEndpoint string
+	sessionID      string
+
+	accessKeyID     string
+	accessKeySecret string
+
+	loginType  LoginType
+	userName   string
+	project    string
+	httpClient *http.Client
+
+	mu sync.Mutex
+}
+
+// Options configures the connection to the ZStack endpoint.
+type Options struct {
+	// CACert is a PEM CA bundle, or the path of one, trusted in addition
+	// to the system roots.
+	CACert string
+	// ClientCert and ClientKey are a PEM client certificate and key, or the
+	// paths of them, for endpoints requiring mutual TLS.
+	ClientCert string
+	ClientKey  string
+	// Insecure skips the verification of the endpoint certificate.
+	Insecure bool
+	// Timeout limits each HTTP request, defaultHTTPTimeout when zero.
+	Timeout time.Duration
+
+	// AccessKeyID and AccessKeySecret sign every request with a ZStack
+	// AccessKey instead of logging in with the account and password.
+	AccessKeyID     string
+	AccessKeySecret string
+
+	// LoginType selects how to login, by account when empty. The user,
+	// LDAP and IAM2 logins identify with UserName, the user login also
+	// with the account name.
+	LoginType LoginType
+	UserName  string
+	// Project is the name or UUID of the IAM2 project to login to.
+	Project string
+}
+
+func (client *Client) Init(AccountName, Password, ServerEndpoint string) error {
+	return client.InitWithOptions(AccountName, Password, ServerEndpoint, Options{})
+}
+
+func (client *Client) InitWithOptions(AccountName, Password, ServerEndpoint string, opts Options) error {
+	hsha512 := sha512.New()
+	io.WriteString(hsha512, Password)
+	client.accountName = AccountName
+	client.password = fmt.Sprintf("%x", hsha512.Sum(nil))
+	if opts.LoginType == LoginTypeLdap {
+		//LDAP servers check the password themselves
+		client.password = Password
+	}
+	client.loginType = opts.LoginType
+	client.userName = opts.UserName
+	client.project = opts.Project
+	client.serverEndpoint = ServerEndpoint
+	httpClient, err := newHTTPClient(opts)
+	if err != nil {
+		return err
+	}
+	client.httpClient = httpClient
+	if opts.AccessKeyID != "" {
+		client.accessKeyID = opts.AccessKeyID
+		client.accessKeySecret = opts.AccessKeySecret
+		return nil
+	}
+	return client.login()
+}
+
+func newHTTPClient(opts Options) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CACert != "" {
+		caCert, err := readPEM(opts.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error while reading CA certificate")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificate found in the CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		certPEM, err := readPEM(opts.ClientCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error while reading client certificate")
+		}
+		keyPEM, err := readPEM(opts.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error while reading client key")
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error while loading client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}, nil
+}
+
+// readPEM returns value itself when it is PEM content, otherwise the content
+// of the file it names.
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+func (client *Client) login() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.loginLocked()
+}
+
+// renewSession logs in again unless another request has done it already
+// since staleSessionID was used.
+func (client *Client) renewSession(staleSessionID string) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.sessionID != staleSessionID {
+		return nil
+	}
+	return client.loginLocked()
+}
+
+// session returns the current session. It is only renewed when ZStack
+// rejects it: the expiredDate of the login carries no time zone, so it can
+// not be compared with the local clock.
+func (client *Client) session() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.sessionID
+}
+
+func (client *Client) loginLocked() error {
+	uri, login := client.loginRequest()
+	loginResponse, err := client.postLogin(http.MethodPost, uri, "", login)
+	if err != nil {
+		return err
+	}
+
+	if client.loginType == LoginTypeIAM2 && client.project != "" {
+		projectName, err := client.iam2ProjectName(loginResponse.Inventory.UUID)
+		if err != nil {
+			return err
+		}
+		projectLogin := LoginIAM2ProjectRequest{
+			LoginIAM2Project: map[string]string{
+				"projectName": projectName,
+			},
+		}
+		loginResponse, err = client.postLogin(http.MethodPut, iam2ProjectLoginURI, loginResponse.Inventory.UUID, projectLogin)
+		if err != nil {
+			return errors.Wrapf(err, "Get error while login to project %s", client.project)
+		}
+	}
+
+	client.sessionID = loginResponse.Inventory.UUID
+	return nil
+}
+
+func (client *Client) loginRequest() (string, LoginRequest) {
+	login := LoginRequest{
+		Tags: Tags{
+			SystemTags: []string{},
+			UserTags:   []string{},
+		},
+	}
+	switch client.loginType {
+	case LoginTypeUser:
+		login.LogInByUser = map[string]string{
+			"accountName": client.accountName,
+			"userName":    client.userName,
+			"password":    client.password,
+		}
+		return userLoginURI, login
+	case LoginTypeLdap:
+		login.LogInByLdap = map[string]string{
+			"uid":      client.userName,
+			"password": client.password,
+		}
+		return ldapLoginURI, login
+	case LoginTypeIAM2:
+		login.LoginIAM2VirtualID = map[string]string{
+			"name":     client.userName,
+			"password": client.password,
+		}
+		return iam2LoginURI, login
+	}
+	login.LoginContent = map[string]string{
+		"password":    client.password,
+		"accountName": client.accountName,
+	}
+	return loginURI, login
+}
+
+func (client *Client) postLogin(method, uri, sessionID string, login interface{}) (*LoginResponse, error) {
+	requestBody, _ := json.Marshal(login)
+	resp, err := client.send(context.Background(), method, uri, sessionID, requestBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get error while login request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get error while getting data from login response")
+	}
+
+	var prettyJSON bytes.Buffer
+	err = json.Indent(&prettyJSON, respBody, "", "    ")
+	log.Println(string(prettyJSON.Bytes()))
+
+	loginResponse := LoginResponse{}
+	errorResponse := ErrorResponse{}
+
+	if int(resp.StatusCode/100) != 2 {
+		if err := json.Unmarshal(respBody, &errorResponse); err != nil {
+			return nil, errors.Wrap(err, "Get error while decoding login response")
+		}
+		return nil, errors.New(errorResponse.Error.Description + " " + errorResponse.Error.Details)
+	}
+	if err := json.Unmarshal(respBody, &loginResponse); err != nil {
+		return nil, errors.Wrap(err, "Get error while decoding login response")
+	}
+	return &loginResponse, nil
+}
+
+// iam2ProjectName returns the name of the project to login to, looking it
+// up when the project is given by UUID.
+func (client *Client) iam2ProjectName(sessionID string) (string, error) {
+	if !uuidPattern.MatchString(client.project) {
+		return client.project, nil
+	}
+	values := (&QueryParams{}).Eq("uuid", client.project).Values()
+	resp, err := client.send(context.Background(), http.MethodGet, iam2ProjectsURI+"?"+values.Encode(), sessionID, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Get error while querying project")
+	}
+	defer resp.Body.Close()
+	projects := struct {
+		Inventories []struct {
+			Name string `json:"name"`
+		} `json:"inventories"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&projects); err != nil {
+		return "", errors.Wrap(err, "Get error while decoding project response")
+	}
+	if len(projects.Inventories) == 0 {
+		return "", errors.Errorf("project %s not found", client.project)
+	}
+	return projects.Inventories[0].Name, nil
+}
+
+func (client *Client) Cleanup() error {
+	if client.sessionID == "" {
+		return nil
+	}
+	return client.deleteSessionID()
+
+}
+
+func (client *Client) deleteSessionID() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	URI := strings.Replace(logoutURI, "{uuid}", client.sessionID, -1)
+	resp, err := client.send(context.Background(), http.MethodDelete, URI, client.sessionID, nil)
+	if err != nil {
+		return errors.Wrap(err, "Get error while logout request")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("delete session id request does not get 200 response code")
+	}
+	client.sessionID = ""
+	return nil
+}
+
+func (client *Client) CreateRequestWithURI(method, uri string, body []byte) (*http.Response, error) {
+	return client.CreateRequestWithURIContext(context.Background(), method, uri, body)
+}
+
+// CreateRequestWithURIContext sends an authenticated request. A request
+// rejected because the session has expired is replayed once after logging
+// in again.
+func (client *Client) CreateRequestWithURIContext(ctx context.Context, method, uri string, body []byte) (*http.Response, error) {
+	sessionID := client.session()
+	resp, err := client.send(ctx, method, uri, sessionID, body)
+	if err != nil || client.accessKeyID != "" {
+		return resp, err
+	}
+	expired, err := sessionExpired(resp)
+	if err != nil || !expired {
+		return resp, err
+	}
+
+	if err := client.renewSession(sessionID); err != nil {
+		return nil, errors.Wrap(err, "Get error while renewing expired session")
+	}
+	return client.send(ctx, method, uri, client.session(), body)
+}
+
+func (client *Client) send(ctx context.Context, method, uri, sessionID string, body []byte) (*http.Response, error) {
+	urlPath := client.serverEndpoint + uri
+	httpRequest, err := http.NewRequest(method, urlPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if client.accessKeyID != "" {
+		client.sign(httpRequest)
+	} else if sessionID != "" {
+		httpRequest.Header.Add("Authorization", "OAuth "+sessionID)
+	}
+	resp, err := client.httpClient.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// sign adds the AccessKey signature of the request: the base64 HMAC-SHA1,
+// keyed by the secret, of the method, date and API path without the /zstack
+// context path, separated by new lines.
+func (client *Client) sign(request *http.Request) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	uri := strings.TrimPrefix(request.URL.Path, zstackContextPath)
+	mac := hmac.New(sha1.New, []byte(client.accessKeySecret))
+	io.WriteString(mac, request.Method+"\n"+date+"\n"+uri)
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	request.Header.Set("Date", date)
+	request.Header.Set("Authorization", "ZStack "+client.accessKeyID+":"+signature)
+}
+
+// sessionExpired reports whether ZStack rejected the request because of an
+// invalid or expired session. The response body stays readable.
+func sessionExpired(resp *http.Response) (bool, error) {
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return true, nil
+	}
+	if resp.StatusCode/100 != 4 {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	errorResponse := ErrorResponse{}
+	if json.Unmarshal(body, &errorResponse) != nil {
+		return false, nil
+	}
+	for _, code := range sessionErrorCodes {
+		if errorResponse.Error.Code == code {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,272 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const defaultPageSize = 100
+
+type QueryResponse struct {
+	Error       *Error          `json:"error,omitempty"`
+	Inventories json.RawMessage `json:"inventories,omitempty"`
+	Total       int64           `json:"total,omitempty"`
+}
+
+// QueryParams builds the query string of a ZStack query API: conditions
+// (q=field=value), paging (limit/start), count, sort and field projection.
+// A nil *QueryParams queries everything.
+type QueryParams struct {
+	Conditions     []string
+	Limit          int
+	Start          int
+	Count          bool
+	Sort           string
+	Fields         []string
+	ReplyWithCount bool
+}
+
+func NewQueryParams() *QueryParams {
+	return &QueryParams{}
+}
+
+// Where adds raw ZStack conditions such as "name=foo" or "state!=Destroyed".
+func (p *QueryParams) Where(conditions ...string) *QueryParams {
+	p.Conditions = append(p.Conditions, conditions...)
+	return p
+}
+
+func (p *QueryParams) Eq(field, value string) *QueryParams {
+	return p.Where(field + "=" + value)
+}
+
+func (p *QueryParams) NotEq(field, value string) *QueryParams {
+	return p.Where(field + "!=" + value)
+}
+
+func (p *QueryParams) In(field string, values ...string) *QueryParams {
+	return p.Where(field + "?=" + strings.Join(values, ","))
+}
+
+func (p *QueryParams) NotIn(field string, values ...string) *QueryParams {
+	return p.Where(field + "!?=" + strings.Join(values, ","))
+}
+
+// Like matches with SQL wildcards, e.g. Like("name", "rancher-%").
+func (p *QueryParams) Like(field, pattern string) *QueryParams {
+	return p.Where(field + "~=" + pattern)
+}
+
+func (p *QueryParams) NotLike(field, pattern string) *QueryParams {
+	return p.Where(field + "!~=" + pattern)
+}
+
+func (p *QueryParams) Gt(field, value string) *QueryParams {
+	return p.Where(field + ">" + value)
+}
+
+func (p *QueryParams) Gte(field, value string) *QueryParams {
+	return p.Where(field + ">=" + value)
+}
+
+func (p *QueryParams) Lt(field, value string) *QueryParams {
+	return p.Where(field + "<" + value)
+}
+
+func (p *QueryParams) Lte(field, value string) *QueryParams {
+	return p.Where(field + "<=" + value)
+}
+
+func (p *QueryParams) IsNull(field string) *QueryParams {
+	return p.Where(field + " is null")
+}
+
+func (p *QueryParams) NotNull(field string) *QueryParams {
+	return p.Where(field + " not null")
+}
+
+func (p *QueryParams) SetLimit(limit int) *QueryParams {
+	p.Limit = limit
+	return p
+}
+
+func (p *QueryParams) SetStart(start int) *QueryParams {
+	p.Start = start
+	return p
+}
+
+// SortBy orders the result by field, ascending or descending.
+func (p *QueryParams) SortBy(field string, ascending bool) *QueryParams {
+	if ascending {
+		p.Sort = "+" + field
+	} else {
+		p.Sort = "-" + field
+	}
+	return p
+}
+
+// SetFields limits the returned inventories to the given fields.
+func (p *QueryParams) SetFields(fields ...string) *QueryParams {
+	p.Fields = append(p.Fields, fields...)
+	return p
+}
+
+func (p *QueryParams) WithCount() *QueryParams {
+	p.ReplyWithCount = true
+	return p
+}
+
+func (p *QueryParams) Values() url.Values {
+	values := url.Values{}
+	if p == nil {
+		return values
+	}
+	for _, condition := range p.Conditions {
+		values.Add("q", condition)
+	}
+	if p.Limit > 0 {
+		values.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Start > 0 {
+		values.Set("start", strconv.Itoa(p.Start))
+	}
+	if p.Count {
+		values.Set("count", "true")
+	}
+	if p.Sort != "" {
+		values.Set("sort", p.Sort)
+	}
+	if len(p.Fields) > 0 {
+		values.Set("fields", strings.Join(p.Fields, ","))
+	}
+	if p.ReplyWithCount {
+		values.Set("replyWithCount", "true")
+	}
+	return values
+}
+
+func (p *QueryParams) copy() *QueryParams {
+	c := QueryParams{}
+	if p != nil {
+		c = *p
+		c.Conditions = append([]string(nil), p.Conditions...)
+		c.Fields = append([]string(nil), p.Fields...)
+	}
+	return &c
+}
+
+// Query sends a GET request to the resource URI with the given params and
+// decodes the inventories into out.
+func (client *Client) Query(uri string, params *QueryParams, out interface{}) error {
+	_, err := client.query(uri, params, out)
+	return err
+}
+
+// QueryCount returns the number of resources matching params without
+// fetching them.
+func (client *Client) QueryCount(uri string, params *QueryParams) (int64, error) {
+	params = params.copy()
+	params.Count = true
+	return client.query(uri, params, nil)
+}
+
+func (client *Client) query(uri string, params *QueryParams, out interface{}) (int64, error) {
+	if values := params.Values(); len(values) > 0 {
+		uri = uri + "?" + values.Encode()
+	}
+
+	resp, err := client.CreateRequestWithURI(http.MethodGet, uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	responseStruct := QueryResponse{}
+	if err = json.Unmarshal(responseBody, &responseStruct); err != nil {
+		logrus.Warnf("Unmarshaling response when querying %s. Error: %s", uri, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		if responseStruct.Error != nil {
+			return 0, responseStruct.Error.WrapError()
+		}
+		return 0, fmt.Errorf("status code %d,Error massage %s", resp.StatusCode, string(responseBody))
+	}
+	if out == nil || len(responseStruct.Inventories) == 0 {
+		return responseStruct.Total, nil
+	}
+	return responseStruct.Total, json.Unmarshal(responseStruct.Inventories, out)
+}
+
+// Pager walks through a large query result page by page.
+type Pager struct {
+	client   *Client
+	uri      string
+	params   *QueryParams
+	pageSize int
+	fetched  int64
+	total    int64
+	done     bool
+}
+
+// NewPager returns a Pager over uri. The Limit and Start of params are
+// managed by the pager; a pageSize <= 0 uses the default page size.
+func (client *Client) NewPager(uri string, params *QueryParams, pageSize int) *Pager {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	params = params.copy()
+	params.Limit = pageSize
+	params.ReplyWithCount = true
+	return &Pager{
+		client:   client,
+		uri:      uri,
+		params:   params,
+		pageSize: pageSize,
+		total:    -1,
+	}
+}
+
+// Next decodes the next page into out, which must point to a slice, and
+// reports whether there was a page to read.
+func (p *Pager) Next(out interface{}) (bool, error) {
+	if p.done {
+		return false, nil
+	}
+	page := []json.RawMessage{}
+	total, err := p.client.query(p.uri, p.params, &page)
+	if err != nil {
+		return false, err
+	}
+	p.total = total
+	p.fetched += int64(len(page))
+	p.params.Start += p.pageSize
+	if len(page) < p.pageSize || (p.total > 0 && p.fetched >= p.total) {
+		p.done = true
+	}
+	if len(page) == 0 {
+		return false, nil
+	}
+
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(raw, out)
+}
+
+// Total returns the number of matching resources reported by ZStack, or -1
+// before the first page has been fetched.
+func (p *Pager) Total() int64 {
+	return p.total
+}
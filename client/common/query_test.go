@@ -0,0 +1,156 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestQueryParamsValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		params *QueryParams
+		want   string
+	}{
+		{"nil", nil, ""},
+		{"empty", NewQueryParams(), ""},
+		{
+			"conditions in order",
+			NewQueryParams().Eq("name", "a b").NotEq("state", "Destroyed").In("uuid", "1", "2").NotIn("type", "x").Like("name", "rancher-%"),
+			"q=name%3Da+b&q=state%21%3DDestroyed&q=uuid%3F%3D1%2C2&q=type%21%3F%3Dx&q=name~%3Drancher-%25",
+		},
+		{
+			"null and comparisons",
+			NewQueryParams().IsNull("hostUuid").NotNull("ip").Gt("size", "1").Lte("cpuNum", "4"),
+			"q=hostUuid+is+null&q=ip+not+null&q=size%3E1&q=cpuNum%3C%3D4",
+		},
+		{"limit and start", NewQueryParams().SetLimit(10).SetStart(20), "limit=10&start=20"},
+		{"zero limit and start", NewQueryParams().SetLimit(0).SetStart(0), ""},
+		{"reply with count", NewQueryParams().WithCount(), "replyWithCount=true"},
+		{"count", &QueryParams{Count: true}, "count=true"},
+		{"fields", NewQueryParams().SetFields("uuid").SetFields("name"), "fields=uuid%2Cname"},
+		{"sort ascending", NewQueryParams().SortBy("createDate", true), "sort=%2BcreateDate"},
+		{"sort descending", NewQueryParams().SortBy("createDate", false), "sort=-createDate"},
+	}
+	for _, test := range tests {
+		if got := test.params.Values().Encode(); got != test.want {
+			t.Errorf("%s: query = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestQueryCountKeepsParams(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"total":3}`))
+	}))
+	defer server.Close()
+	client := &Client{serverEndpoint: server.URL, httpClient: server.Client()}
+
+	params := NewQueryParams().Eq("name", "a")
+	total, err := client.QueryCount("/zstack/v1/vm-instances", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || query != "count=true&q=name%3Da" {
+		t.Errorf("total = %d, query = %s", total, query)
+	}
+	if params.Count {
+		t.Error("QueryCount changed the params of the caller")
+	}
+}
+
+// pagedServer serves items resources, honoring limit and start, and reports
+// the total unless hideTotal.
+func pagedServer(t *testing.T, items int, hideTotal bool, requests *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.URL.RawQuery)
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		start, _ := strconv.Atoi(query.Get("start"))
+		if query.Get("replyWithCount") != "true" {
+			t.Errorf("query %s does not ask for the count", r.URL.RawQuery)
+		}
+		inventories := []map[string]int{}
+		for i := start; i < items && i < start+limit; i++ {
+			inventories = append(inventories, map[string]int{"index": i})
+		}
+		response := map[string]interface{}{"inventories": inventories}
+		if !hideTotal {
+			response["total"] = items
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestPager(t *testing.T) {
+	tests := []struct {
+		name         string
+		items        int
+		hideTotal    bool
+		wantRequests []string
+	}{
+		{"empty", 0, false, []string{"limit=100&q=state%3DRunning&replyWithCount=true"}},
+		{"short last page", 250, false, []string{
+			"limit=100&q=state%3DRunning&replyWithCount=true",
+			"limit=100&q=state%3DRunning&replyWithCount=true&start=100",
+			"limit=100&q=state%3DRunning&replyWithCount=true&start=200",
+		}},
+		// the total ends the walk without asking for an empty page
+		{"full last page", 200, false, []string{
+			"limit=100&q=state%3DRunning&replyWithCount=true",
+			"limit=100&q=state%3DRunning&replyWithCount=true&start=100",
+		}},
+		{"full last page without total", 200, true, []string{
+			"limit=100&q=state%3DRunning&replyWithCount=true",
+			"limit=100&q=state%3DRunning&replyWithCount=true&start=100",
+			"limit=100&q=state%3DRunning&replyWithCount=true&start=200",
+		}},
+	}
+	for _, test := range tests {
+		var requests []string
+		server := pagedServer(t, test.items, test.hideTotal, &requests)
+		client := &Client{serverEndpoint: server.URL, httpClient: server.Client()}
+		pager := client.NewPager("/zstack/v1/vm-instances", NewQueryParams().Eq("state", "Running"), 0)
+
+		var got []map[string]int
+		for {
+			page := []map[string]int{}
+			more, err := pager.Next(&page)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !more {
+				break
+			}
+			got = append(got, page...)
+		}
+		// a finished pager sends nothing more
+		if more, err := pager.Next(&[]map[string]int{}); more || err != nil {
+			t.Errorf("%s: Next after the end = %v, %v", test.name, more, err)
+		}
+		server.Close()
+
+		if len(got) != test.items {
+			t.Errorf("%s: read %d items, want %d", test.name, len(got), test.items)
+		}
+		for i, item := range got {
+			if item["index"] != i {
+				t.Errorf("%s: item %d is %d", test.name, i, item["index"])
+				break
+			}
+		}
+		if len(requests) != len(test.wantRequests) {
+			t.Errorf("%s: requests = %v, want %v", test.name, requests, test.wantRequests)
+			continue
+		}
+		for i := range requests {
+			if requests[i] != test.wantRequests[i] {
+				t.Errorf("%s: request %d = %s, want %s", test.name, i, requests[i], test.wantRequests[i])
+			}
+		}
+	}
+}
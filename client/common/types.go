@@ -1,10 +1,12 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -13,9 +15,30 @@ import (
 )
 
 const (
-	loginURI                = "/zstack/v1/accounts/login"
-	logoutURI               = "/zstack/v1/accounts/sessions/{uuid}"
-	defaultQueryAsyncPeriod = 1 * time.Second
+	loginURI            = "/zstack/v1/accounts/login"
+	userLoginURI        = "/zstack/v1/accounts/users/login"
+	ldapLoginURI        = "/zstack/v1/ldap/login"
+	iam2LoginURI        = "/zstack/v1/iam2/virtual-ids/login"
+	iam2ProjectLoginURI = "/zstack/v1/iam2/projects/login"
+	iam2ProjectsURI     = "/zstack/v1/iam2/projects"
+	logoutURI           = "/zstack/v1/accounts/sessions/{uuid}"
+)
+
+const (
+	defaultHTTPTimeout = 60 * time.Second
+	zstackContextPath  = "/zstack"
+)
+
+// sessionErrorCodes are the ZStack error codes of invalid or expired sessions.
+var sessionErrorCodes = []string{"ID.1001", "ID.1002"}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var (
+	// AsyncPollInterval is the delay before the first poll of an async job.
+	AsyncPollInterval = 1 * time.Second
+	// AsyncMaxPollInterval caps the backoff between two polls of an async job.
+	AsyncMaxPollInterval = 10 * time.Second
 )
 
 type ResourceBase struct {
@@ -29,9 +52,26 @@ type Tags struct {
 	UserTags   []string `json:"userTags,omitempty"`
 }
 
+type LoginType string
+
+const (
+	LoginTypeAccount LoginType = "account"
+	LoginTypeUser    LoginType = "user"
+	LoginTypeLdap    LoginType = "ldap"
+	LoginTypeIAM2    LoginType = "iam2"
+)
+
 type LoginRequest struct {
-	LoginContent map[string]string `json:"logInByAccount,omitempty"`
-	Tags         `json:",inline"`
+	LoginContent       map[string]string `json:"logInByAccount,omitempty"`
+	LogInByUser        map[string]string `json:"logInByUser,omitempty"`
+	LogInByLdap        map[string]string `json:"logInByLdap,omitempty"`
+	LoginIAM2VirtualID map[string]string `json:"loginIAM2VirtualID,omitempty"`
+	Tags               `json:",inline"`
+}
+
+type LoginIAM2ProjectRequest struct {
+	LoginIAM2Project map[string]string `json:"loginIAM2Project"`
+	Tags             `json:",inline"`
 }
 
 type LoginResponse struct {
@@ -45,7 +85,7 @@ type LoginResponse struct {
 }
 
 type ErrorResponse struct {
-	Error	Error `json:"error,omitempty"`
+	Error Error `json:"error,omitempty"`
 }
 
 type ZStack503Error struct {
@@ -105,26 +145,47 @@ func GetAsyncResponse(c *Client, resp *http.Response) (*AsyncResponse, error) {
 }
 
 func (async *AsyncResponse) QueryRealResponse(i interface{}, timeout time.Duration) error {
-	timeouter := time.After(timeout)
-	ticker := time.NewTicker(defaultQueryAsyncPeriod)
-	defer ticker.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return async.QueryRealResponseWithContext(ctx, i)
+}
+
+// QueryRealResponseWithContext polls the job location with an increasing
+// interval until the job ends or ctx is done. Giving up the wait does not
+// stop the ZStack job: the APIs are not long jobs and can't be cancelled.
+func (async *AsyncResponse) QueryRealResponseWithContext(ctx context.Context, i interface{}) error {
+	interval := AsyncPollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 	for {
 		select {
-		case <-timeouter:
-			return fmt.Errorf("querying location: %s timeout", async.Location)
-		case <-ticker.C:
-			resp, err := async.QueryLocation()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("querying location: %s timeout", async.Location)
+			}
+			return errors.Wrapf(ctx.Err(), "querying location: %s", async.Location)
+		case <-timer.C:
+			resp, err := async.QueryLocationWithContext(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
 				return err
 			}
 			switch resp.StatusCode {
 			case 202:
 				//If job still running, ZStack will return code 202 continely.
 				resp.Body.Close()
+				interval = interval * 3 / 2
+				if interval > AsyncMaxPollInterval {
+					interval = AsyncMaxPollInterval
+				}
+				timer.Reset(interval)
 				continue
 			case 200:
 				//Job success
 				responseBody, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
 				if err != nil {
 					return err
 				}
@@ -139,6 +200,7 @@ func (async *AsyncResponse) QueryRealResponse(i interface{}, timeout time.Durati
 				return fmt.Errorf("location %s is no longer available", async.Location)
 			case 503:
 				responseBody, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
 				if err != nil {
 					logrus.WithError(err).Error("the ZStack returns a code 503")
 					return err
@@ -151,6 +213,7 @@ func (async *AsyncResponse) QueryRealResponse(i interface{}, timeout time.Durati
 				return zstack503Error.Error.WrapError()
 			default:
 				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
 				if err != nil {
 					logrus.WithError(err).Errorf("get status code %d and get data error", resp.StatusCode)
 				}
@@ -161,9 +224,13 @@ func (async *AsyncResponse) QueryRealResponse(i interface{}, timeout time.Durati
 }
 
 func (async *AsyncResponse) QueryLocation() (*http.Response, error) {
+	return async.QueryLocationWithContext(context.Background())
+}
+
+func (async *AsyncResponse) QueryLocationWithContext(ctx context.Context) (*http.Response, error) {
 	request, err := http.NewRequest(http.MethodGet, async.Location, nil)
 	if err != nil {
 		return nil, err
 	}
-	return async.client.httpClient.Do(request)
+	return async.client.httpClient.Do(request.WithContext(ctx))
 }
@@ -0,0 +1,17 @@
+package infrastructure
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+type Cluster struct {
+	*common.Client
+}
+
+func (c *Cluster) QueryClusters(params *common.QueryParams) ([]*ClusterInventory, error) {
+	clusters := []*ClusterInventory{}
+	if err := c.Query(queryClustersURI, params, &clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
@@ -0,0 +1,17 @@
+package infrastructure
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+type Host struct {
+	*common.Client
+}
+
+func (c *Host) QueryHosts(params *common.QueryParams) ([]*HostInventory, error) {
+	hosts := []*HostInventory{}
+	if err := c.Query(queryHostsURI, params, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,17 @@
+package infrastructure
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+type PrimaryStorage struct {
+	*common.Client
+}
+
+func (c *PrimaryStorage) QueryPrimaryStorages(params *common.QueryParams) ([]*PrimaryStorageInventory, error) {
+	storages := []*PrimaryStorageInventory{}
+	if err := c.Query(queryPrimaryStorageURI, params, &storages); err != nil {
+		return nil, err
+	}
+	return storages, nil
+}
@@ -0,0 +1,62 @@
+package infrastructure
+
+import "github.com/cnrancher/docker-machine-driver-zstack/client/common"
+
+const (
+	queryZonesURI          = "/zstack/v1/zones"
+	queryClustersURI       = "/zstack/v1/clusters"
+	queryHostsURI          = "/zstack/v1/hosts"
+	queryPrimaryStorageURI = "/zstack/v1/primary-storage"
+)
+
+type ZoneInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	State       string `json:"state,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+type ClusterInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name           string `json:"name,omitempty"`
+	Description    string `json:"description,omitempty"`
+	State          string `json:"state,omitempty"`
+	HypervisorType string `json:"hypervisorType,omitempty"`
+	ZoneUUID       string `json:"zoneUuid,omitempty"`
+	Type           string `json:"type,omitempty"`
+}
+
+type HostInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name                    string `json:"name,omitempty"`
+	Description             string `json:"description,omitempty"`
+	ZoneUUID                string `json:"zoneUuid,omitempty"`
+	ClusterUUID             string `json:"clusterUuid,omitempty"`
+	ManagementIP            string `json:"managementIp,omitempty"`
+	HypervisorType          string `json:"hypervisorType,omitempty"`
+	State                   string `json:"state,omitempty"`
+	Status                  string `json:"status,omitempty"`
+	TotalCPUCapacity        int64  `json:"totalCpuCapacity,omitempty"`
+	AvailableCPUCapacity    int64  `json:"availableCpuCapacity,omitempty"`
+	TotalMemoryCapacity     int64  `json:"totalMemoryCapacity,omitempty"`
+	AvailableMemoryCapacity int64  `json:"availableMemoryCapacity,omitempty"`
+}
+
+type PrimaryStorageInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name                 string   `json:"name,omitempty"`
+	Description          string   `json:"description,omitempty"`
+	ZoneUUID             string   `json:"zoneUuid,omitempty"`
+	URL                  string   `json:"url,omitempty"`
+	Type                 string   `json:"type,omitempty"`
+	State                string   `json:"state,omitempty"`
+	Status               string   `json:"status,omitempty"`
+	TotalCapacity        int64    `json:"totalCapacity,omitempty"`
+	AvailableCapacity    int64    `json:"availableCapacity,omitempty"`
+	AttachedClusterUUIDs []string `json:"attachedClusterUuids,omitempty"`
+}
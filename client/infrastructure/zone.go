@@ -0,0 +1,17 @@
+package infrastructure
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+type Zone struct {
+	*common.Client
+}
+
+func (c *Zone) QueryZones(params *common.QueryParams) ([]*ZoneInventory, error) {
+	zones := []*ZoneInventory{}
+	if err := c.Query(queryZonesURI, params, &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
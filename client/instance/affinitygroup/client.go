@@ -0,0 +1,126 @@
+package affinitygroup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createAffinityGroupURI = "/zstack/v1/affinity-groups"
+	deleteAffinityGroupURI = "/zstack/v1/affinity-groups/{uuid}"
+	queryAffinityGroupsURI = "/zstack/v1/affinity-groups"
+	addVMInstanceURI       = "/zstack/v1/affinity-groups/{affinityGroupUuid}/vm-instances/{uuid}"
+	removeVMInstancesURI   = "/zstack/v1/affinity-groups/{affinityGroupUuid}/vm-instances"
+
+	// PolicyAntiSoft spreads the VMs over hosts when it can, PolicyAntiHard
+	// fails the placement otherwise.
+	PolicyAntiSoft = "antiSoft"
+	PolicyAntiHard = "antiHard"
+
+	TypeHost = "host"
+
+	// SystemTag places a new VM instance in the affinity group.
+	SystemTag = "affinityGroupUuid::%s"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateAffinityGroupRequest struct {
+	Params struct {
+		Name        string `json:"name,omitempty"`
+		Description string `json:"description,omitempty"`
+		Policy      string `json:"policy,omitempty"`
+		Type        string `json:"type,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type Response struct {
+	Error     *common.Error           `json:"error,omitempty"`
+	Inventory *AffinityGroupInventory `json:"inventory,omitempty"`
+}
+
+type AffinityGroupInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name        string        `json:"name,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Policy      string        `json:"policy,omitempty"`
+	Type        string        `json:"type,omitempty"`
+	State       string        `json:"state,omitempty"`
+	Usages      []*UsageEntry `json:"usages,omitempty"`
+}
+
+type UsageEntry struct {
+	AffinityGroupUUID string `json:"affinityGroupUuid,omitempty"`
+	ResourceUUID      string `json:"resourceUuid,omitempty"`
+	ResourceType      string `json:"resourceType,omitempty"`
+}
+
+// Contains reports whether the resource is a member of the group.
+func (g *AffinityGroupInventory) Contains(resourceUUID string) bool {
+	for _, usage := range g.Usages {
+		if usage.ResourceUUID == resourceUUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) CreateAffinityGroup(req CreateAffinityGroupRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createAffinityGroupURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DeleteAffinityGroup(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteAffinityGroupURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryAffinityGroups(params *common.QueryParams) ([]*AffinityGroupInventory, error) {
+	groups := []*AffinityGroupInventory{}
+	if err := c.Query(queryAffinityGroupsURI, params, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// AddVMInstance adds a running VM to the group, it is not migrated if the
+// group policy is violated.
+func (c *Client) AddVMInstance(affinityGroupUUID, vmInstanceUUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(addVMInstanceURI, "{affinityGroupUuid}", affinityGroupUUID, -1)
+	realURI = strings.Replace(realURI, "{uuid}", vmInstanceUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) RemoveVMInstances(affinityGroupUUID string, vmInstanceUUIDs []string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(removeVMInstancesURI, "{affinityGroupUuid}", affinityGroupUUID, -1)
+	realURI += "?" + url.Values{"uuids": vmInstanceUUIDs}.Encode()
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
@@ -10,16 +10,16 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/cnrancher/go-zstack/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
 	"github.com/pkg/errors"
 )
 
 type Client struct {
-	common.Client
+	*common.Client
 }
 
 func NewInstanceClient(accountName string, password string, endpoint string) *Client {
-	client := &Client{}
+	client := &Client{Client: &common.Client{}}
 	err := client.Init(accountName, password, endpoint)
 	if err != nil {
 		logrus.Errorf("Get instance client error, reason: %s", err.Error())
@@ -38,7 +38,7 @@ func (c *Client) CreateInstance(req CreateRequest) (*common.AsyncResponse, error
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
 func (c *Client) DeleteInstance(UUID string) (*common.AsyncResponse, error) {
@@ -47,7 +47,7 @@ func (c *Client) DeleteInstance(UUID string) (*common.AsyncResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
 func (c *Client) ExpungeInstance(UUID string) (*common.AsyncResponse, error) {
@@ -65,7 +65,7 @@ func (c *Client) ExpungeInstance(UUID string) (*common.AsyncResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
 func (c *Client) QueryInstance(UUID string) (*VMInstanceInventory, error) {
@@ -90,32 +90,23 @@ func (c *Client) QueryInstance(UUID string) (*VMInstanceInventory, error) {
 		return nil, fmt.Errorf("status code %d,Error massage %s", resp.StatusCode, string(responseBody))
 	}
 	if len(responseStruct.Inventories) == 0 {
-		return nil, fmt.Errorf("can't get any instance informations, expect one")
+		return nil, ErrInstanceNotFound
 	}
 	return responseStruct.Inventories[0], nil
 }
 
-func (c *Client) QueryInstances() ([]*VMInstanceInventory, error) {
-	resp, err := c.CreateRequestWithURI(http.MethodGet, queryInstancesURI, nil)
-	if err != nil {
-		return nil, err
-	}
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+func (c *Client) QueryInstances(params *common.QueryParams) ([]*VMInstanceInventory, error) {
+	instances := []*VMInstanceInventory{}
+	if err := c.Query(queryInstancesURI, params, &instances); err != nil {
 		return nil, err
 	}
+	return instances, nil
+}
 
-	responseStruct := QueryInstanceResponse{}
-	if err = json.Unmarshal(responseBody, &responseStruct); err != nil {
-		logrus.Warnf("Unmarshaling response when Querying instance. Error: %s", err.Error())
-	}
-	if resp.StatusCode != 200 {
-		if responseStruct.Error != nil {
-			return nil, responseStruct.Error.WrapError()
-		}
-		return nil, fmt.Errorf("status code %d,Error massage %s", resp.StatusCode, string(responseBody))
-	}
-	return responseStruct.Inventories, nil
+// InstancePager pages through the instances matching params, decoding each
+// page into a []*VMInstanceInventory.
+func (c *Client) InstancePager(params *common.QueryParams, pageSize int) *common.Pager {
+	return c.NewPager(queryInstancesURI, params, pageSize)
 }
 
 func (c *Client) StartInstance(UUID string) (*common.AsyncResponse, error) {
@@ -133,7 +124,7 @@ func (c *Client) StartInstance(UUID string) (*common.AsyncResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
 func (c *Client) StopInstance(UUID string, stopType StopInstanceType) (*common.AsyncResponse, error) {
@@ -150,7 +141,7 @@ func (c *Client) StopInstance(UUID string, stopType StopInstanceType) (*common.A
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
 func (c *Client) RestartInstance(UUID string) (*common.AsyncResponse, error) {
@@ -168,10 +159,10 @@ func (c *Client) RestartInstance(UUID string) (*common.AsyncResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	return common.GetAsyncResponse(&c.Client, resp)
+	return common.GetAsyncResponse(c.Client, resp)
 }
 
-func (c *Client) WaitForInstance(UUID string, state string, timeout int) error {
+func (c *Client) WaitForInstance(UUID string, state VMInstanceState, timeout int) error {
 
 	if timeout <= 0 {
 		timeout = InstanceDefaultTimeout
@@ -187,7 +178,7 @@ func (c *Client) WaitForInstance(UUID string, state string, timeout int) error {
 		}
 		timeout = timeout - DefaultWaitForInterval
 		if timeout <= 0 {
-			return errors.Errorf("Timeout")
+			return errors.Errorf("timeout waiting for instance %s to become %s", UUID, state)
 		}
 		time.Sleep(DefaultWaitForInterval * time.Second)
 	}
@@ -0,0 +1,15 @@
+package instance
+
+import "github.com/cnrancher/docker-machine-driver-zstack/client/common"
+
+type Image struct {
+	*common.Client
+}
+
+func (c *Image) QueryImages(params *common.QueryParams) ([]*ImageInventory, error) {
+	images := []*ImageInventory{}
+	if err := c.Query(queryImagesURI, params, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
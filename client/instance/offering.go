@@ -0,0 +1,50 @@
+package instance
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createOfferingURI = "/zstack/v1/instance-offerings"
+	queryOfferingsURI = "/zstack/v1/instance-offerings"
+	deleteOfferingURI = "/zstack/v1/instance-offerings/{uuid}"
+)
+
+type Offering struct {
+	*common.Client
+}
+
+func (c *Offering) CreateOffering(req CreateOfferingRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createOfferingURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Offering) DeleteOffering(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteOfferingURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Offering) QueryOfferings(params *common.QueryParams) ([]*OfferingInventory, error) {
+	offerings := []*OfferingInventory{}
+	if err := c.Query(queryOfferingsURI, params, &offerings); err != nil {
+		return nil, err
+	}
+	return offerings, nil
+}
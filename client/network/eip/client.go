@@ -0,0 +1,98 @@
+package eip
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createEipURI = "/zstack/v1/eips"
+	deleteEipURI = "/zstack/v1/eips/{uuid}"
+	attachEipURI = "/zstack/v1/eips/{eipUuid}/vm-instances/nics/{vmNicUuid}"
+	detachEipURI = "/zstack/v1/eips/{uuid}/vm-instances/nics"
+	queryEipsURI = "/zstack/v1/eips"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateEipRequest struct {
+	Params struct {
+		Name        string `json:"name,omitempty"`
+		Description string `json:"description,omitempty"`
+		VipUUID     string `json:"vipUuid,omitempty"`
+		VMNicUUID   string `json:"vmNicUuid,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type Response struct {
+	Error     *common.Error `json:"error,omitempty"`
+	Inventory *EipInventory `json:"inventory,omitempty"`
+}
+
+type EipInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	VMNicUUID   string `json:"vmNicUuid,omitempty"`
+	VipUUID     string `json:"vipUuid,omitempty"`
+	State       string `json:"state,omitempty"`
+	VipIP       string `json:"vipIp,omitempty"`
+	GuestIP     string `json:"guestIp,omitempty"`
+}
+
+func (c *Client) CreateEip(req CreateEipRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createEipURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+// AttachEip binds the EIP to a VM NIC.
+func (c *Client) AttachEip(eipUUID, vmNicUUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(attachEipURI, "{eipUuid}", eipUUID, -1)
+	realURI = strings.Replace(realURI, "{vmNicUuid}", vmNicUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DetachEip(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(detachEipURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DeleteEip(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteEipURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryEips(params *common.QueryParams) ([]*EipInventory, error) {
+	eips := []*EipInventory{}
+	if err := c.Query(queryEipsURI, params, &eips); err != nil {
+		return nil, err
+	}
+	return eips, nil
+}
@@ -0,0 +1,112 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	queryL3NetworksURI     = "/zstack/v1/l3-networks"
+	checkIPAvailabilityURI = "/zstack/v1/l3-networks/{l3NetworkUuid}/ip/{ip}/availability"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type L3NetworkInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name          string `json:"name,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Type          string `json:"type,omitempty"`
+	ZoneUUID      string `json:"zoneUuid,omitempty"`
+	L2NetworkUUID string `json:"l2NetworkUuid,omitempty"`
+	State         string `json:"state,omitempty"`
+	DNSDomain     string `json:"dnsDomain,omitempty"`
+	System        bool   `json:"system,omitempty"`
+	Category      string `json:"category,omitempty"`
+
+	IPRanges []*IPRangeInventory `json:"ipRanges,omitempty"`
+}
+
+type IPRangeInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	L3NetworkUUID string `json:"l3NetworkUuid,omitempty"`
+	Name          string `json:"name,omitempty"`
+	StartIP       string `json:"startIp,omitempty"`
+	EndIP         string `json:"endIp,omitempty"`
+	Netmask       string `json:"netmask,omitempty"`
+	Gateway       string `json:"gateway,omitempty"`
+	NetworkCidr   string `json:"networkCidr,omitempty"`
+}
+
+// Contains reports whether ip lies between the start and end IP of the range.
+func (r *IPRangeInventory) Contains(ip net.IP) bool {
+	start, end := net.ParseIP(r.StartIP), net.ParseIP(r.EndIP)
+	if start == nil || end == nil || ip == nil {
+		return false
+	}
+	ip16 := ip.To16()
+	return bytes.Compare(ip16, start.To16()) >= 0 && bytes.Compare(ip16, end.To16()) <= 0
+}
+
+// Contains reports whether ip lies in one of the IP ranges of the network.
+func (n *L3NetworkInventory) Contains(ip net.IP) bool {
+	for _, r := range n.IPRanges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type IPAvailability struct {
+	Error     *common.Error `json:"error,omitempty"`
+	Available bool          `json:"available"`
+	Reason    string        `json:"reason,omitempty"`
+}
+
+func (c *Client) QueryL3Networks(params *common.QueryParams) ([]*L3NetworkInventory, error) {
+	networks := []*L3NetworkInventory{}
+	if err := c.Query(queryL3NetworksURI, params, &networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// CheckIPAvailability tells whether ip is free to be used in the L3 network.
+func (c *Client) CheckIPAvailability(l3NetworkUUID, ip string) (*IPAvailability, error) {
+	realURI := strings.Replace(checkIPAvailabilityURI, "{l3NetworkUuid}", l3NetworkUUID, -1)
+	realURI = strings.Replace(realURI, "{ip}", ip, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodGet, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	responseStruct := IPAvailability{}
+	if err = json.Unmarshal(responseBody, &responseStruct); err != nil {
+		logrus.Warnf("Unmarshaling response when checking ip availability. Error: %s", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		if responseStruct.Error != nil {
+			return nil, responseStruct.Error.WrapError()
+		}
+		return nil, fmt.Errorf("status code %d,Error massage %s", resp.StatusCode, string(responseBody))
+	}
+	return &responseStruct, nil
+}
@@ -0,0 +1,103 @@
+package portforwarding
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createRuleURI = "/zstack/v1/port-forwarding"
+	deleteRuleURI = "/zstack/v1/port-forwarding/{uuid}"
+	attachRuleURI = "/zstack/v1/port-forwarding/{ruleUuid}/vm-instances/nics/{vmNicUuid}"
+	queryRulesURI = "/zstack/v1/port-forwarding"
+
+	ProtocolTCP = "TCP"
+	ProtocolUDP = "UDP"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateRuleRequest struct {
+	Params struct {
+		Name             string `json:"name,omitempty"`
+		Description      string `json:"description,omitempty"`
+		VipUUID          string `json:"vipUuid,omitempty"`
+		VipPortStart     int    `json:"vipPortStart,omitempty"`
+		VipPortEnd       int    `json:"vipPortEnd,omitempty"`
+		PrivatePortStart int    `json:"privatePortStart,omitempty"`
+		PrivatePortEnd   int    `json:"privatePortEnd,omitempty"`
+		ProtocolType     string `json:"protocolType,omitempty"`
+		VMNicUUID        string `json:"vmNicUuid,omitempty"`
+		AllowedCidr      string `json:"allowedCidr,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type Response struct {
+	Error     *common.Error  `json:"error,omitempty"`
+	Inventory *RuleInventory `json:"inventory,omitempty"`
+}
+
+type RuleInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name             string `json:"name,omitempty"`
+	Description      string `json:"description,omitempty"`
+	VipIP            string `json:"vipIp,omitempty"`
+	GuestIP          string `json:"guestIp,omitempty"`
+	VipUUID          string `json:"vipUuid,omitempty"`
+	VipPortStart     int    `json:"vipPortStart,omitempty"`
+	VipPortEnd       int    `json:"vipPortEnd,omitempty"`
+	PrivatePortStart int    `json:"privatePortStart,omitempty"`
+	PrivatePortEnd   int    `json:"privatePortEnd,omitempty"`
+	VMNicUUID        string `json:"vmNicUuid,omitempty"`
+	ProtocolType     string `json:"protocolType,omitempty"`
+	State            string `json:"state,omitempty"`
+	AllowedCidr      string `json:"allowedCidr,omitempty"`
+}
+
+func (c *Client) CreateRule(req CreateRuleRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createRuleURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+// AttachRule binds the rule to a VM NIC.
+func (c *Client) AttachRule(ruleUUID, vmNicUUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(attachRuleURI, "{ruleUuid}", ruleUUID, -1)
+	realURI = strings.Replace(realURI, "{vmNicUuid}", vmNicUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DeleteRule(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteRuleURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryRules(params *common.QueryParams) ([]*RuleInventory, error) {
+	rules := []*RuleInventory{}
+	if err := c.Query(queryRulesURI, params, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,165 @@
+package securitygroup
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createSecurityGroupURI = "/zstack/v1/security-groups"
+	deleteSecurityGroupURI = "/zstack/v1/security-groups/{uuid}"
+	querySecurityGroupsURI = "/zstack/v1/security-groups"
+	addRulesURI            = "/zstack/v1/security-groups/{securityGroupUuid}/rules"
+	attachL3NetworkURI     = "/zstack/v1/security-groups/{securityGroupUuid}/l3-networks/{l3NetworkUuid}"
+	addVMNicsURI           = "/zstack/v1/security-groups/{securityGroupUuid}/vm-instances/nics"
+
+	RuleTypeIngress = "Ingress"
+	RuleTypeEgress  = "Egress"
+
+	ProtocolTCP  = "TCP"
+	ProtocolUDP  = "UDP"
+	ProtocolICMP = "ICMP"
+	ProtocolALL  = "ALL"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateSecurityGroupRequest struct {
+	Params struct {
+		Name        string `json:"name,omitempty"`
+		Description string `json:"description,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type Rule struct {
+	Type        string `json:"type,omitempty"`
+	StartPort   int    `json:"startPort"`
+	EndPort     int    `json:"endPort"`
+	Protocol    string `json:"protocol,omitempty"`
+	AllowedCidr string `json:"allowedCidr,omitempty"`
+}
+
+type AddRulesRequest struct {
+	Params struct {
+		Rules []*Rule `json:"rules"`
+	} `json:"params"`
+}
+
+type AddVMNicsRequest struct {
+	Params struct {
+		VMNicUUIDs []string `json:"vmNicUuids"`
+	} `json:"params"`
+}
+
+type Response struct {
+	Error     *common.Error           `json:"error,omitempty"`
+	Inventory *SecurityGroupInventory `json:"inventory,omitempty"`
+}
+
+type SecurityGroupInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name                   string           `json:"name,omitempty"`
+	Description            string           `json:"description,omitempty"`
+	State                  string           `json:"state,omitempty"`
+	AttachedL3NetworkUUIDs []string         `json:"attachedL3NetworkUuids,omitempty"`
+	Rules                  []*RuleInventory `json:"rules,omitempty"`
+}
+
+type RuleInventory struct {
+	common.ResourceBase `json:",inline"`
+	Rule                `json:",inline"`
+
+	SecurityGroupUUID string `json:"securityGroupUuid,omitempty"`
+	State             string `json:"state,omitempty"`
+}
+
+// AttachedTo reports whether the group is attached to the L3 network.
+func (g *SecurityGroupInventory) AttachedTo(l3NetworkUUID string) bool {
+	for _, uuid := range g.AttachedL3NetworkUUIDs {
+		if uuid == l3NetworkUUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) CreateSecurityGroup(req CreateSecurityGroupRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createSecurityGroupURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DeleteSecurityGroup(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteSecurityGroupURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QuerySecurityGroups(params *common.QueryParams) ([]*SecurityGroupInventory, error) {
+	groups := []*SecurityGroupInventory{}
+	if err := c.Query(querySecurityGroupsURI, params, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (c *Client) AddRules(securityGroupUUID string, rules []*Rule) (*common.AsyncResponse, error) {
+	requestStruct := AddRulesRequest{}
+	requestStruct.Params.Rules = rules
+	requestBody, err := json.Marshal(requestStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	realURI := strings.Replace(addRulesURI, "{securityGroupUuid}", securityGroupUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+// AttachL3Network enables the group on an L3 network, which is required
+// before NICs of that network can join the group.
+func (c *Client) AttachL3Network(securityGroupUUID, l3NetworkUUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(attachL3NetworkURI, "{securityGroupUuid}", securityGroupUUID, -1)
+	realURI = strings.Replace(realURI, "{l3NetworkUuid}", l3NetworkUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) AddVMNics(securityGroupUUID string, vmNicUUIDs []string) (*common.AsyncResponse, error) {
+	requestStruct := AddVMNicsRequest{}
+	requestStruct.Params.VMNicUUIDs = vmNicUUIDs
+	requestBody, err := json.Marshal(requestStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	realURI := strings.Replace(addVMNicsURI, "{securityGroupUuid}", securityGroupUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
@@ -0,0 +1,79 @@
+package vip
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createVipURI = "/zstack/v1/vips"
+	deleteVipURI = "/zstack/v1/vips/{uuid}"
+	queryVipsURI = "/zstack/v1/vips"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateVipRequest struct {
+	Params struct {
+		Name          string `json:"name,omitempty"`
+		Description   string `json:"description,omitempty"`
+		L3NetworkUUID string `json:"l3NetworkUuid,omitempty"`
+		RequiredIP    string `json:"requiredIp,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type Response struct {
+	Error     *common.Error `json:"error,omitempty"`
+	Inventory *VipInventory `json:"inventory,omitempty"`
+}
+
+type VipInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name              string `json:"name,omitempty"`
+	Description       string `json:"description,omitempty"`
+	L3NetworkUUID     string `json:"l3NetworkUuid,omitempty"`
+	IP                string `json:"ip,omitempty"`
+	State             string `json:"state,omitempty"`
+	Gateway           string `json:"gateway,omitempty"`
+	Netmask           string `json:"netmask,omitempty"`
+	ServiceProvider   string `json:"serviceProvider,omitempty"`
+	PeerL3NetworkUUID string `json:"peerL3NetworkUuid,omitempty"`
+	UseFor            string `json:"useFor,omitempty"`
+}
+
+func (c *Client) CreateVip(req CreateVipRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createVipURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) DeleteVip(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteVipURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryVips(params *common.QueryParams) ([]*VipInventory, error) {
+	vips := []*VipInventory{}
+	if err := c.Query(queryVipsURI, params, &vips); err != nil {
+		return nil, err
+	}
+	return vips, nil
+}
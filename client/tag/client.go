@@ -0,0 +1,91 @@
+package tag
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createUserTagURI = "/zstack/v1/user-tags"
+	queryUserTagsURI = "/zstack/v1/user-tags"
+	deleteTagURI     = "/zstack/v1/tags/{uuid}"
+
+	ResourceTypeVMInstance         = "VmInstanceVO"
+	ResourceTypeVolume             = "VolumeVO"
+	ResourceTypeVip                = "VipVO"
+	ResourceTypeEip                = "EipVO"
+	ResourceTypeSecurityGroup      = "SecurityGroupVO"
+	ResourceTypePortForwardingRule = "PortForwardingRuleVO"
+	ResourceTypeInstanceOffering   = "InstanceOfferingVO"
+	ResourceTypeAffinityGroup      = "AffinityGroupVO"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateUserTagRequest struct {
+	Params struct {
+		ResourceType string `json:"resourceType,omitempty"`
+		ResourceUUID string `json:"resourceUuid,omitempty"`
+		Tag          string `json:"tag,omitempty"`
+	} `json:"params,omitempty"`
+}
+
+type Response struct {
+	Error     *common.Error `json:"error,omitempty"`
+	Inventory *TagInventory `json:"inventory,omitempty"`
+}
+
+type TagInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	ResourceUUID string `json:"resourceUuid,omitempty"`
+	ResourceType string `json:"resourceType,omitempty"`
+	Tag          string `json:"tag,omitempty"`
+	Type         string `json:"type,omitempty"`
+}
+
+// CreateUserTag attaches a user tag to an existing resource.
+func (c *Client) CreateUserTag(resourceType, resourceUUID, tag string) (*common.AsyncResponse, error) {
+	requestStruct := CreateUserTagRequest{}
+	requestStruct.Params.ResourceType = resourceType
+	requestStruct.Params.ResourceUUID = resourceUUID
+	requestStruct.Params.Tag = tag
+	requestBody, err := json.Marshal(requestStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createUserTagURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryUserTags(params *common.QueryParams) ([]*TagInventory, error) {
+	tags := []*TagInventory{}
+	if err := c.Query(queryUserTagsURI, params, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// UserTagPager pages through the user tags matching params, decoding each
+// page into a []*TagInventory.
+func (c *Client) UserTagPager(params *common.QueryParams, pageSize int) *common.Pager {
+	return c.NewPager(queryUserTagsURI, params, pageSize)
+}
+
+func (c *Client) DeleteTag(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteTagURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
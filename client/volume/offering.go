@@ -0,0 +1,33 @@
+package volume
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	queryDiskOfferingsURI = "/zstack/v1/disk-offerings"
+)
+
+type Offering struct {
+	*common.Client
+}
+
+type DiskOfferingInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name              string `json:"name,omitempty"`
+	Description       string `json:"description,omitempty"`
+	DiskSize          int64  `json:"diskSize,omitempty"`
+	SortKey           int    `json:"sortKey,omitempty"`
+	State             string `json:"state,omitempty"`
+	Type              string `json:"type,omitempty"`
+	AllocatorStrategy string `json:"allocatorStrategy,omitempty"`
+}
+
+func (c *Offering) QueryDiskOfferings(params *common.QueryParams) ([]*DiskOfferingInventory, error) {
+	offerings := []*DiskOfferingInventory{}
+	if err := c.Query(queryDiskOfferingsURI, params, &offerings); err != nil {
+		return nil, err
+	}
+	return offerings, nil
+}
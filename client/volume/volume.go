@@ -0,0 +1,154 @@
+package volume
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+)
+
+const (
+	createDataVolumeURI = "/zstack/v1/volumes/data"
+	deleteVolumeURI     = "/zstack/v1/volumes/{uuid}"
+	operateVolumeURI    = "/zstack/v1/volumes/{uuid}/actions"
+	attachVolumeURI     = "/zstack/v1/volumes/{volumeUuid}/vm-instances/{vmInstanceUuid}"
+	resizeRootVolumeURI = "/zstack/v1/volumes/resize/{uuid}/actions"
+	queryVolumesURI     = "/zstack/v1/volumes"
+
+	VolumeTypeRoot = "Root"
+	VolumeTypeData = "Data"
+
+	// VolumeStatusDeleted is the status of a deleted volume until it is
+	// expunged.
+	VolumeStatusDeleted = "Deleted"
+)
+
+type Client struct {
+	*common.Client
+}
+
+type CreateDataVolumeRequest struct {
+	Params struct {
+		Name               string `json:"name,omitempty"`
+		Description        string `json:"description,omitempty"`
+		DiskOfferingUUID   string `json:"diskOfferingUuid,omitempty"`
+		DiskSize           int64  `json:"diskSize,omitempty"`
+		PrimaryStorageUUID string `json:"primaryStorageUuid,omitempty"`
+	} `json:"params,omitempty"`
+	common.Tags `json:",inline"`
+}
+
+type ExpungeDataVolumeRequest struct {
+	ExpungeDataVolume map[string]string `json:"expungeDataVolume"`
+	common.Tags       `json:",inline"`
+}
+
+type ResizeRootVolumeRequest struct {
+	ResizeRootVolume struct {
+		Size int64 `json:"size"`
+	} `json:"resizeRootVolume"`
+	common.Tags `json:",inline"`
+}
+
+type Response struct {
+	Error     *common.Error    `json:"error,omitempty"`
+	Inventory *VolumeInventory `json:"inventory,omitempty"`
+}
+
+type VolumeInventory struct {
+	common.ResourceBase `json:",inline"`
+
+	Name               string `json:"name,omitempty"`
+	Description        string `json:"description,omitempty"`
+	PrimaryStorageUUID string `json:"primaryStorageUuid,omitempty"`
+	VMInstanceUUID     string `json:"vmInstanceUuid,omitempty"`
+	DiskOfferingUUID   string `json:"diskOfferingUuid,omitempty"`
+	RootImageUUID      string `json:"rootImageUuid,omitempty"`
+	InstallPath        string `json:"installPath,omitempty"`
+	Type               string `json:"type,omitempty"`
+	Format             string `json:"format,omitempty"`
+	Size               int64  `json:"size,omitempty"`
+	ActualSize         int64  `json:"actualSize,omitempty"`
+	DeviceID           int    `json:"deviceId,omitempty"`
+	State              string `json:"state,omitempty"`
+	Status             string `json:"status,omitempty"`
+	IsShareable        bool   `json:"isShareable,omitempty"`
+}
+
+func (c *Client) CreateDataVolume(req CreateDataVolumeRequest) (*common.AsyncResponse, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.CreateRequestWithURI(http.MethodPost, createDataVolumeURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) AttachDataVolume(volumeUUID, vmInstanceUUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(attachVolumeURI, "{volumeUuid}", volumeUUID, -1)
+	realURI = strings.Replace(realURI, "{vmInstanceUuid}", vmInstanceUUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPost, realURI, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+// DeleteDataVolume moves the volume to the recycle bin, ExpungeDataVolume
+// removes it for good.
+func (c *Client) DeleteDataVolume(UUID string) (*common.AsyncResponse, error) {
+	realURI := strings.Replace(deleteVolumeURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodDelete, realURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) ExpungeDataVolume(UUID string) (*common.AsyncResponse, error) {
+	requestStruct := ExpungeDataVolumeRequest{
+		ExpungeDataVolume: map[string]string{},
+	}
+	requestBody, err := json.Marshal(requestStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	realURI := strings.Replace(operateVolumeURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPut, realURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+// ResizeRootVolume expands the root volume to size bytes, volumes can not
+// shrink.
+func (c *Client) ResizeRootVolume(UUID string, size int64) (*common.AsyncResponse, error) {
+	requestStruct := ResizeRootVolumeRequest{}
+	requestStruct.ResizeRootVolume.Size = size
+	requestBody, err := json.Marshal(requestStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	realURI := strings.Replace(resizeRootVolumeURI, "{uuid}", UUID, -1)
+	resp, err := c.CreateRequestWithURI(http.MethodPut, realURI, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return common.GetAsyncResponse(c.Client, resp)
+}
+
+func (c *Client) QueryVolumes(params *common.QueryParams) ([]*VolumeInventory, error) {
+	volumes := []*VolumeInventory{}
+	if err := c.Query(queryVolumesURI, params, &volumes); err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
@@ -0,0 +1,155 @@
+// Command docker-machine-zstack-gc reports the ZStack resources the zstack
+// driver created for machines which are no longer in the docker-machine
+// store, and deletes them with -delete.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/zstack"
+	"github.com/docker/machine/libmachine/mcnutils"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "docker-machine-zstack-gc: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		opts        common.Options
+		endpoint    string
+		account     string
+		password    string
+		loginType   string
+		storePath   string
+		timeout     int
+		httpTimeout int
+		remove      bool
+	)
+	insecure, err := envBool("ZSTACK_INSECURE")
+	if err != nil {
+		return err
+	}
+	defaultHTTPTimeout, err := envInt("ZSTACK_HTTP_TIMEOUT", 60)
+	if err != nil {
+		return err
+	}
+	flag.StringVar(&endpoint, "endpoint", os.Getenv("ZSTACK_ENDPOINT"), "ZStack API endpoint, e.g. http://zstack:8080")
+	flag.StringVar(&loginType, "login-type", envOr("ZSTACK_LOGIN_TYPE", string(common.LoginTypeAccount)), "account, user, ldap or iam2")
+	flag.StringVar(&account, "account", os.Getenv("ZSTACK_ACCOUNT_NAME"), "account name")
+	flag.StringVar(&opts.UserName, "user", os.Getenv("ZSTACK_USER_NAME"), "user name for the user, ldap and iam2 login types")
+	flag.StringVar(&password, "password", os.Getenv("ZSTACK_ACCOUNT_PASSWORD"), "password")
+	flag.StringVar(&opts.Project, "project", os.Getenv("ZSTACK_PROJECT"), "project for the iam2 login type")
+	flag.StringVar(&opts.AccessKeyID, "access-key-id", os.Getenv("ZSTACK_ACCESS_KEY_ID"), "AccessKey ID to sign requests with instead of logging in")
+	flag.StringVar(&opts.AccessKeySecret, "access-key-secret", os.Getenv("ZSTACK_ACCESS_KEY_SECRET"), "AccessKey secret")
+	flag.StringVar(&opts.CACert, "ca-cert", os.Getenv("ZSTACK_CA_CERT"), "PEM CA bundle, or its path, to trust")
+	flag.StringVar(&opts.ClientCert, "client-cert", os.Getenv("ZSTACK_CLIENT_CERT"), "PEM client certificate, or its path, for endpoints requiring mutual TLS")
+	flag.StringVar(&opts.ClientKey, "client-key", os.Getenv("ZSTACK_CLIENT_KEY"), "PEM client key, or its path")
+	flag.BoolVar(&opts.Insecure, "insecure", insecure, "skip the verification of the endpoint certificate")
+	flag.IntVar(&httpTimeout, "http-timeout", defaultHTTPTimeout, "seconds to wait for each request to the endpoint")
+	flag.StringVar(&storePath, "storage-path", defaultStorePath(), "docker-machine store the resources were created for")
+	flag.IntVar(&timeout, "timeout", 300, "seconds to wait for each delete")
+	flag.BoolVar(&remove, "delete", false, "delete the orphans, only report them otherwise")
+	flag.Parse()
+	opts.LoginType = common.LoginType(loginType)
+	opts.Timeout = time.Duration(httpTimeout) * time.Second
+
+	if endpoint == "" {
+		return errors.New("-endpoint is required")
+	}
+	if (opts.ClientCert == "") != (opts.ClientKey == "") {
+		return errors.New("-client-cert and -client-key must be set together")
+	}
+
+	client := &common.Client{}
+	if err := client.InitWithOptions(account, password, endpoint, opts); err != nil {
+		return err
+	}
+	defer client.Cleanup()
+
+	// the store path must be given as docker-machine passed it to the
+	// driver, it is matched by its hash
+	collector := zstack.NewCollector(client, storePath)
+	collector.Timeout = timeout
+	orphans, err := collector.Orphans()
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		fmt.Printf("No orphans of %s\n", storePath)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tUUID\tMACHINE\tREASON\tRESULT")
+	failed := 0
+	for _, orphan := range orphans {
+		result := "dry run"
+		if remove {
+			result = "deleted"
+			if err := collector.Delete(orphan); err != nil {
+				result = "failed: " + err.Error()
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orphan.ResourceType, orphan.UUID, orphan.Machine, orphan.Reason, result)
+	}
+	w.Flush()
+
+	if !remove {
+		fmt.Printf("%d orphans of %s, run with -delete to delete them\n", len(orphans), storePath)
+	} else if failed > 0 {
+		return fmt.Errorf("%d of %d orphans were not deleted", failed, len(orphans))
+	}
+	return nil
+}
+
+func defaultStorePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(mcnutils.GetHomeDir(), ".docker", "machine")
+}
+
+// envBool parses a boolean environment variable, false when unset.
+func envBool(key string) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expect true or false", key, v)
+	}
+	return b, nil
+}
+
+func envInt(key string, value int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return value, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q, expect a number of seconds", key, v)
+	}
+	return i, nil
+}
+
+func envOr(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
@@ -0,0 +1,198 @@
+package zstack
+
+import (
+	"fmt"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance/affinitygroup"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAffinityGroupPolicy = affinitygroup.PolicyAntiSoft
+
+	affinityGroupDescription = "Created by docker-machine"
+)
+
+var affinityGroupPolicies = map[string]bool{
+	affinitygroup.PolicyAntiSoft: true,
+	affinitygroup.PolicyAntiHard: true,
+}
+
+// joinAffinityGroup looks up the affinity group by name, or creates it,
+// and returns the system tag which places the new VM in it.
+func (d *Driver) joinAffinityGroup() (string, error) {
+	if d.AffinityGroup == "" {
+		return "", nil
+	}
+	if d.AffinityGroupUUID == "" {
+		groups, err := d.queryAffinityGroups()
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == 0 {
+			created, err := d.createAffinityGroup()
+			if err != nil {
+				return "", err
+			}
+			// machines created in parallel may each have created the
+			// group, they all settle on the oldest one
+			if groups, err = d.queryAffinityGroups(); err != nil {
+				return "", err
+			}
+			if len(groups) == 0 {
+				return "", errors.Errorf("affinity group %s not found after creating it", d.AffinityGroup)
+			}
+			if groups[0].UUID == created {
+				d.affinityGroupCreated = true
+			} else if err := d.deleteAffinityGroup(created); err != nil {
+				return "", err
+			}
+		} else if len(groups) > 1 {
+			log.Warnf("%d affinity groups are named %s, using the oldest %s", len(groups), d.AffinityGroup, groups[0].UUID)
+		}
+		if groups[0].Policy != d.AffinityGroupPolicy {
+			return "", errors.Errorf("The affinity group %s has the policy %s, not %s.", d.AffinityGroup, groups[0].Policy, d.AffinityGroupPolicy)
+		}
+		d.AffinityGroupUUID = groups[0].UUID
+	}
+	return fmt.Sprintf(affinitygroup.SystemTag, d.AffinityGroupUUID), nil
+}
+
+// queryAffinityGroups returns the groups named d.AffinityGroup, the oldest
+// first.
+func (d *Driver) queryAffinityGroups() ([]*affinitygroup.AffinityGroupInventory, error) {
+	groups, err := d.affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("name", d.AffinityGroup).SortBy("createDate", true))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get error when query affinity group %s.", d.AffinityGroup)
+	}
+	return groups, nil
+}
+
+func (d *Driver) createAffinityGroup() (string, error) {
+	request := affinitygroup.CreateAffinityGroupRequest{}
+	request.Params.Name = d.AffinityGroup
+	request.Params.Description = affinityGroupDescription
+	request.Params.Policy = d.AffinityGroupPolicy
+	request.Params.Type = affinitygroup.TypeHost
+	request.UserTags = d.sharedTags()
+	async, err := d.affinityGroupClient.CreateAffinityGroup(request)
+	if err != nil {
+		return "", errors.Wrap(err, "Get error when create affinity group in zstack.")
+	}
+	response := affinitygroup.Response{}
+	if err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return "", errors.Wrap(err, "Get error when create affinity group in zstack.")
+	}
+	if response.Error != nil {
+		return "", errors.Wrap(response.Error.WrapError(), "Get error when create affinity group in zstack.")
+	}
+	log.Infof("Created %s affinity group %s", d.AffinityGroupPolicy, d.AffinityGroup)
+	return response.Inventory.UUID, nil
+}
+
+func (d *Driver) deleteAffinityGroup(uuid string) error {
+	async, err := d.affinityGroupClient.DeleteAffinityGroup(uuid)
+	if err == nil {
+		err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when delete zstack affinity group %s.", uuid)
+	}
+	return nil
+}
+
+// dropAffinityGroup deletes the affinity group created for a VM which
+// failed to create, unless another machine joined it meanwhile.
+func (d *Driver) dropAffinityGroup() {
+	if !d.affinityGroupCreated {
+		return
+	}
+	summary := &removeSummary{}
+	d.removeFromAffinityGroup(summary)
+	if err := summary.report(d.MachineName); err != nil {
+		log.Warnf("The affinity group %s is left: %v", d.AffinityGroup, err)
+	}
+	d.affinityGroupCreated = false
+}
+
+// addToAffinityGroup adds the VM to the affinity group when the system tag
+// of the create request did not.
+func (d *Driver) addToAffinityGroup(inventory *instance.VMInstanceInventory) error {
+	if d.AffinityGroupUUID == "" {
+		return nil
+	}
+	groups, err := d.affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("uuid", d.AffinityGroupUUID))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query affinity group %s.", d.AffinityGroupUUID)
+	}
+	if len(groups) == 0 {
+		return errors.Errorf("affinity group %s not found", d.AffinityGroupUUID)
+	}
+	if !groups[0].Contains(inventory.UUID) {
+		async, err := d.affinityGroupClient.AddVMInstance(d.AffinityGroupUUID, inventory.UUID)
+		if err == nil {
+			err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Get error when add the vm instance to the affinity group.")
+		}
+	}
+	log.Infof("Instance %s is in affinity group %s on host %s", inventory.UUID, d.AffinityGroup, inventory.HostUUID)
+	return nil
+}
+
+// removeFromAffinityGroup takes the VM out of its affinity group, and
+// deletes the group when a machine of this store created it and it has no
+// members left.
+func (d *Driver) removeFromAffinityGroup(summary *removeSummary) {
+	if d.AffinityGroupUUID == "" {
+		return
+	}
+	groups, err := d.affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("uuid", d.AffinityGroupUUID))
+	if err != nil {
+		summary.fail("affinity group", d.AffinityGroupUUID, errors.Wrapf(err, "Get error when query affinity group %s.", d.AffinityGroupUUID))
+		return
+	}
+	if len(groups) == 0 {
+		summary.record("affinity group", d.AffinityGroupUUID, resultGone)
+		d.AffinityGroupUUID = ""
+		return
+	}
+	group := groups[0]
+
+	if d.InstanceUUID != "" && group.Contains(d.InstanceUUID) {
+		async, err := d.affinityGroupClient.RemoveVMInstances(group.UUID, []string{d.InstanceUUID})
+		if err == nil {
+			err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			summary.fail("affinity group", group.UUID, errors.Wrap(err, "Get error when remove the vm instance from the affinity group."))
+			return
+		}
+		var usages []*affinitygroup.UsageEntry
+		for _, usage := range group.Usages {
+			if usage.ResourceUUID != d.InstanceUUID {
+				usages = append(usages, usage)
+			}
+		}
+		group.Usages = usages
+	}
+
+	result := "left"
+	if len(group.Usages) == 0 {
+		owned, err := d.createdByStore(group.UUID)
+		if err == nil && owned {
+			err = d.deleteAffinityGroup(group.UUID)
+			result = resultRemoved
+		}
+		if err != nil {
+			summary.fail("affinity group", group.UUID, err)
+			return
+		}
+	}
+	summary.record("affinity group", group.UUID, result)
+	d.AffinityGroupUUID = ""
+}
@@ -0,0 +1,244 @@
+package zstack
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDiskFSType     = "ext4"
+	defaultDiskMountPoint = "/var/lib/docker"
+
+	diskLayoutScriptPath = "/tmp/zstack-disk-layout.sh"
+
+	// growpart exits 1 when the partition already fills the disk
+	growRootScript = `set -e
+dev=$(findmnt -no SOURCE /)
+disk=/dev/$(lsblk -no PKNAME "$dev" | head -n1)
+part=$(cat /sys/class/block/$(basename "$dev")/partition 2>/dev/null || true)
+if [ -n "$part" ]; then
+	growpart "$disk" "$part" || [ $? -eq 1 ]
+fi
+case $(findmnt -no FSTYPE /) in
+xfs) xfs_growfs / ;;
+ext2|ext3|ext4) resize2fs "$dev" ;;
+*) echo "can not grow the $(findmnt -no FSTYPE /) root file system" >&2; exit 1 ;;
+esac
+`
+)
+
+var (
+	mountPointPattern = regexp.MustCompile(`^/[A-Za-z0-9._/-]*$`)
+
+	// the mkfs options to format a whole, empty disk
+	mkfsOptions = map[string]string{
+		"ext4": "-F",
+		"xfs":  "",
+	}
+)
+
+// diskMount mounts the data volume at DeviceID, the ZStack device ID of the
+// volume in the VM, on MountPoint.
+type diskMount struct {
+	DeviceID   int
+	FSType     string
+	MountPoint string
+	VolumeUUID string
+}
+
+// parseDiskLayout parses comma or newline separated deviceId=mountpoint[:fstype]
+// entries, e.g. "1=/var/lib/docker,2=/var/lib/longhorn:xfs".
+func parseDiskLayout(spec string) ([]*diskMount, error) {
+	var mounts []*diskMount
+	devices := map[int]bool{}
+	mountPoints := map[string]bool{}
+	for _, entry := range splitList(strings.Replace(spec, "\n", ",", -1)) {
+		if strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid disk layout %q, expect deviceId=mountpoint[:fstype].", entry)
+		}
+		deviceID, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || deviceID < 1 {
+			return nil, errors.Errorf("Invalid disk layout %q, the device ID of a data volume starts from 1.", entry)
+		}
+
+		mount := &diskMount{DeviceID: deviceID, FSType: defaultDiskFSType, MountPoint: strings.TrimSpace(parts[1])}
+		if i := strings.LastIndex(mount.MountPoint, ":"); i >= 0 {
+			mount.MountPoint, mount.FSType = mount.MountPoint[:i], strings.ToLower(mount.MountPoint[i+1:])
+		}
+		if _, ok := mkfsOptions[mount.FSType]; !ok {
+			return nil, errors.Errorf("Invalid disk layout %q, the file system must be ext4 or xfs.", entry)
+		}
+		if !mountPointPattern.MatchString(mount.MountPoint) || mount.MountPoint == "/" {
+			return nil, errors.Errorf("Invalid disk layout %q, bad mount point %q.", entry, mount.MountPoint)
+		}
+		if devices[deviceID] || mountPoints[mount.MountPoint] {
+			return nil, errors.Errorf("Invalid disk layout %q, the device or mount point is used twice.", entry)
+		}
+		devices[deviceID], mountPoints[mount.MountPoint] = true, true
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// diskMounts maps the disk layout onto the data volumes of the VM. Without
+// a layout the first data volume holds /var/lib/docker.
+func (d *Driver) diskMounts(inventory *instance.VMInstanceInventory) ([]*diskMount, error) {
+	volumes := map[int]string{}
+	var deviceIDs []int
+	for _, v := range inventory.AllVolumes {
+		if v.Type == volume.VolumeTypeData {
+			volumes[v.DeviceID] = v.UUID
+			deviceIDs = append(deviceIDs, v.DeviceID)
+		}
+	}
+	sort.Ints(deviceIDs)
+
+	mounts, err := parseDiskLayout(d.DiskLayout)
+	if err != nil {
+		return nil, err
+	}
+	if d.DiskLayout == "" && len(deviceIDs) > 0 {
+		mounts = []*diskMount{{DeviceID: deviceIDs[0], FSType: defaultDiskFSType, MountPoint: defaultDiskMountPoint}}
+	}
+	for _, mount := range mounts {
+		uuid, ok := volumes[mount.DeviceID]
+		if !ok {
+			return nil, errors.Errorf("The disk layout mounts device %d on %s, but the instance has no data volume at that device.",
+				mount.DeviceID, mount.MountPoint)
+		}
+		mount.VolumeUUID = uuid
+	}
+	return mounts, nil
+}
+
+// diskLayoutScript formats and mounts the data volumes. The volumes are
+// found by their serial, which ZStack sets to the volume UUID, and a run on
+// an already prepared VM changes nothing. Images may come with docker
+// running on /var/lib/docker, so docker is stopped while the volumes are
+// mounted and the existing content of a mount point is copied onto its new
+// file system.
+func diskLayoutScript(mounts []*diskMount) string {
+	script := &bytes.Buffer{}
+	script.WriteString(`#!/bin/sh
+set -e
+
+find_disk() {
+	serial=$(echo "$1" | cut -c1-20)
+	for i in $(seq 30); do
+		for dev in /dev/disk/by-id/*"$serial"*; do
+			case "$dev" in
+			*-part*|*"*"*) ;;
+			*) readlink -f "$dev"; return 0 ;;
+			esac
+		done
+		sleep 1
+	done
+	return 1
+}
+
+docker_stopped=
+stop_docker() {
+	if command -v systemctl >/dev/null 2>&1; then
+		if systemctl is-active -q docker; then
+			systemctl stop docker.socket docker
+			docker_stopped=systemctl
+		fi
+	elif service docker status >/dev/null 2>&1; then
+		service docker stop
+		docker_stopped=service
+	fi
+}
+start_docker() {
+	case "$docker_stopped" in
+	systemctl) systemctl start docker ;;
+	service) service docker start ;;
+	esac
+}
+trap start_docker EXIT
+
+mount_disk() {
+	volume=$1 fstype=$2 mountpoint=$3
+	mountpoint -q "$mountpoint" && return 0
+	dev=$(find_disk "$volume") || { echo "data volume $volume not found" >&2; exit 1; }
+	[ -n "$docker_stopped" ] || stop_docker
+	formatted=
+	if ! blkid "$dev" >/dev/null 2>&1; then
+		mkfs."$fstype" $4 "$dev"
+		formatted=1
+	fi
+	fsuuid=$(blkid -s UUID -o value "$dev")
+	mkdir -p "$mountpoint"
+	if [ -n "$formatted" ] && [ -n "$(ls -A "$mountpoint")" ]; then
+		tmp=$(mktemp -d)
+		mount "$dev" "$tmp"
+		cp -a "$mountpoint"/. "$tmp"/
+		umount "$tmp"
+		rmdir "$tmp"
+	fi
+	grep -q "^UUID=$fsuuid " /etc/fstab || echo "UUID=$fsuuid $mountpoint $fstype defaults,nofail 0 2" >> /etc/fstab
+	mount "$mountpoint"
+}
+
+`)
+	for _, mount := range mounts {
+		fmt.Fprintf(script, "mount_disk %s %s %s %q\n", mount.VolumeUUID, mount.FSType, mount.MountPoint, mkfsOptions[mount.FSType])
+	}
+	return script.String()
+}
+
+// growRootFilesystem grows the root partition and file system into the
+// resized root volume.
+func (d *Driver) growRootFilesystem(sshClient ssh.Client) error {
+	if !d.rootVolumeResized {
+		return nil
+	}
+
+	command := "sh -c '" + growRootScript + "'"
+	if d.GetSSHUsername() != "root" {
+		command = "sudo " + command
+	}
+	output, err := sshClient.Output(command)
+	log.Debugf("%s | Grow root file system err, output: %v: %s", d.MachineName, err, output)
+	if err != nil {
+		return errors.Wrapf(err, "Get error when grow the root file system: %s", output)
+	}
+	return nil
+}
+
+// applyDiskLayout runs the disk layout script on the VM.
+func (d *Driver) applyDiskLayout(sshClient ssh.Client) error {
+	if len(d.diskLayout) == 0 {
+		return nil
+	}
+
+	command := fmt.Sprintf("cat > %s <<'ZSTACK_EOF'\n%sZSTACK_EOF\n", diskLayoutScriptPath, diskLayoutScript(d.diskLayout))
+	if d.GetSSHUsername() == "root" {
+		command += "sh " + diskLayoutScriptPath
+	} else {
+		command += "sudo sh " + diskLayoutScriptPath
+	}
+
+	output, err := sshClient.Output(command)
+	log.Debugf("%s | Disk layout command err, output: %v: %s", d.MachineName, err, output)
+	if err != nil {
+		return errors.Wrapf(err, "Get error when prepare the data volumes: %s", output)
+	}
+	for _, mount := range d.diskLayout {
+		log.Infof("%s | Mounted data volume %s on %s", d.MachineName, mount.VolumeUUID, mount.MountPoint)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package zstack
+
+import (
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/eip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/vip"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// createEIP allocates a VIP on the EIP network and binds it as an EIP to
+// the NIC on the address network, so machines on private networks can be
+// reached from outside.
+func (d *Driver) createEIP(inventory *instance.VMInstanceInventory) error {
+	if d.EIPNetworkUUID == "" {
+		return nil
+	}
+
+	nic := d.addressNIC(inventory)
+	if nic == nil {
+		return errors.Errorf("The instance %s has no nic on l3 network %s to attach the EIP to.", d.InstanceUUID, d.AddressL3NetworkUUID)
+	}
+
+	vipRequest := vip.CreateVipRequest{}
+	vipRequest.Params.Name = d.MachineName
+	vipRequest.Params.L3NetworkUUID = d.EIPNetworkUUID
+	vipRequest.UserTags = d.ownerTags()
+	async, err := d.vipClient.CreateVip(vipRequest)
+	if err != nil {
+		return errors.Wrap(err, "Get error when create vip in zstack.")
+	}
+	vipResponse := vip.Response{}
+	if err = waitForJob(async, &vipResponse, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when create vip in zstack.")
+	}
+	if vipResponse.Error != nil {
+		return errors.Wrap(vipResponse.Error.WrapError(), "Get error when create vip in zstack.")
+	}
+	d.VIPUUID = vipResponse.Inventory.UUID
+
+	eipRequest := eip.CreateEipRequest{}
+	eipRequest.Params.Name = d.MachineName
+	eipRequest.Params.VipUUID = d.VIPUUID
+	eipRequest.UserTags = d.ownerTags()
+	async, err = d.eipClient.CreateEip(eipRequest)
+	if err != nil {
+		return errors.Wrap(err, "Get error when create eip in zstack.")
+	}
+	eipResponse := eip.Response{}
+	if err = waitForJob(async, &eipResponse, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when create eip in zstack.")
+	}
+	if eipResponse.Error != nil {
+		return errors.Wrap(eipResponse.Error.WrapError(), "Get error when create eip in zstack.")
+	}
+	d.EIPUUID = eipResponse.Inventory.UUID
+
+	async, err = d.eipClient.AttachEip(d.EIPUUID, nic.UUID)
+	if err != nil {
+		return errors.Wrap(err, "Get error when attach eip to the vm instance.")
+	}
+	eipResponse = eip.Response{}
+	if err = waitForJob(async, &eipResponse, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when attach eip to the vm instance.")
+	}
+	if eipResponse.Error != nil {
+		return errors.Wrap(eipResponse.Error.WrapError(), "Get error when attach eip to the vm instance.")
+	}
+
+	d.EIPAddress = vipResponse.Inventory.IP
+	log.Infof("Attached EIP %s to instance %s", d.EIPAddress, d.InstanceUUID)
+	return nil
+}
+
+// removeEIP deletes the EIP and then its VIP, which can not be deleted
+// while the EIP uses it.
+func (d *Driver) removeEIP(summary *removeSummary) {
+	if d.EIPUUID != "" && d.deleteIfExists(summary, "eip", d.EIPUUID, func() (int, error) {
+		eips, err := d.eipClient.QueryEips(common.NewQueryParams().Eq("uuid", d.EIPUUID))
+		return len(eips), err
+	}, d.eipClient.DeleteEip) {
+		d.EIPUUID = ""
+	}
+
+	if d.EIPUUID == "" && d.VIPUUID != "" && d.deleteIfExists(summary, "vip", d.VIPUUID, func() (int, error) {
+		vips, err := d.vipClient.QueryVips(common.NewQueryParams().Eq("uuid", d.VIPUUID))
+		return len(vips), err
+	}, d.vipClient.DeleteVip) {
+		d.VIPUUID = ""
+	}
+}
@@ -0,0 +1,267 @@
+package zstack
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance/affinitygroup"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/eip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/portforwarding"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/securitygroup"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/vip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
+	"github.com/pkg/errors"
+)
+
+// the resources are queried by tags in batches of this many UUIDs
+const gcQueryBatch = 100
+
+// gcOrder deletes the resources which use others first.
+var gcOrder = []string{
+	tag.ResourceTypePortForwardingRule,
+	tag.ResourceTypeEip,
+	tag.ResourceTypeVip,
+	tag.ResourceTypeSecurityGroup,
+	tag.ResourceTypeVMInstance,
+	tag.ResourceTypeVolume,
+	tag.ResourceTypeAffinityGroup,
+	tag.ResourceTypeInstanceOffering,
+}
+
+// Orphan is a resource the driver created for a machine of the store which
+// no longer exists, or a shared resource no machine uses any more.
+type Orphan struct {
+	ResourceType string
+	UUID         string
+	// Machine is empty for the shared instance offerings and affinity
+	// groups.
+	Machine string
+	Reason  string
+}
+
+// Collector finds and deletes the orphans of a docker-machine store.
+type Collector struct {
+	// StorePath is the docker-machine store, e.g. ~/.docker/machine.
+	StorePath string
+	// Timeout is the number of seconds to wait for each delete job.
+	Timeout int
+
+	tagClient            *tag.Client
+	instanceClient       *instance.Client
+	offeringClient       *instance.Offering
+	affinityGroupClient  *affinitygroup.Client
+	volumeClient         *volume.Client
+	vipClient            *vip.Client
+	eipClient            *eip.Client
+	securityGroupClient  *securitygroup.Client
+	portForwardingClient *portforwarding.Client
+}
+
+// NewCollector returns a Collector for the store using a logged in client.
+func NewCollector(client *common.Client, storePath string) *Collector {
+	return &Collector{
+		StorePath:            storePath,
+		tagClient:            &tag.Client{Client: client},
+		instanceClient:       &instance.Client{Client: client},
+		offeringClient:       &instance.Offering{Client: client},
+		affinityGroupClient:  &affinitygroup.Client{Client: client},
+		volumeClient:         &volume.Client{Client: client},
+		vipClient:            &vip.Client{Client: client},
+		eipClient:            &eip.Client{Client: client},
+		securityGroupClient:  &securitygroup.Client{Client: client},
+		portForwardingClient: &portforwarding.Client{Client: client},
+	}
+}
+
+// Orphans lists the orphans in the order they can be deleted. Resources
+// of other stores are never reported.
+func (c *Collector) Orphans() ([]*Orphan, error) {
+	owned := map[string]string{}
+	var uuids []string
+	pager := c.tagClient.UserTagPager(common.NewQueryParams().Eq("tag", ownerTag), 0)
+	for {
+		page := []*tag.TagInventory{}
+		more, err := pager.Next(&page)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error when query the resources created by the driver.")
+		}
+		for _, t := range page {
+			if _, ok := owned[t.ResourceUUID]; !ok {
+				owned[t.ResourceUUID] = t.ResourceType
+				uuids = append(uuids, t.ResourceUUID)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+
+	store := storeTagPrefix + storeHash(c.StorePath)
+	var orphans []*Orphan
+	for start := 0; start < len(uuids); start += gcQueryBatch {
+		end := start + gcQueryBatch
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		tags, err := c.tagClient.QueryUserTags(common.NewQueryParams().In("resourceUuid", uuids[start:end]...))
+		if err != nil {
+			return nil, errors.Wrap(err, "Get error when query the tags of the resources.")
+		}
+		inStore, machines := map[string]bool{}, map[string]string{}
+		for _, t := range tags {
+			switch {
+			case t.Tag == store:
+				inStore[t.ResourceUUID] = true
+			case strings.HasPrefix(t.Tag, machineTagPrefix):
+				machines[t.ResourceUUID] = strings.TrimPrefix(t.Tag, machineTagPrefix)
+			}
+		}
+
+		for _, uuid := range uuids[start:end] {
+			if !inStore[uuid] {
+				continue
+			}
+			orphan := &Orphan{ResourceType: owned[uuid], UUID: uuid, Machine: machines[uuid]}
+			if orphan.Machine != "" {
+				if _, err := os.Stat(filepath.Join(c.StorePath, "machines", orphan.Machine)); !os.IsNotExist(err) {
+					continue
+				}
+				orphan.Reason = "machine " + orphan.Machine + " is not in the store"
+			} else {
+				used, err := c.inUse(orphan)
+				if err != nil {
+					return nil, err
+				}
+				if used {
+					continue
+				}
+				orphan.Reason = "not used by any vm"
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	rank := map[string]int{}
+	for i, resourceType := range gcOrder {
+		rank[resourceType] = i
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		if rank[orphans[i].ResourceType] != rank[orphans[j].ResourceType] {
+			return rank[orphans[i].ResourceType] < rank[orphans[j].ResourceType]
+		}
+		return orphans[i].Machine < orphans[j].Machine
+	})
+	return orphans, nil
+}
+
+// inUse reports whether a shared resource still serves a VM.
+func (c *Collector) inUse(orphan *Orphan) (bool, error) {
+	switch orphan.ResourceType {
+	case tag.ResourceTypeInstanceOffering:
+		vms, err := c.instanceClient.QueryInstances(common.NewQueryParams().Eq("instanceOfferingUuid", orphan.UUID).SetFields("uuid"))
+		if err != nil {
+			return false, errors.Wrapf(err, "Get error when query the vms of instance offering %s.", orphan.UUID)
+		}
+		return len(vms) > 0, nil
+	case tag.ResourceTypeAffinityGroup:
+		groups, err := c.affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("uuid", orphan.UUID))
+		if err != nil {
+			return false, errors.Wrapf(err, "Get error when query affinity group %s.", orphan.UUID)
+		}
+		return len(groups) == 0 || len(groups[0].Usages) > 0, nil
+	}
+	// a resource of a machine without its machine tag is left alone
+	return true, nil
+}
+
+// Delete deletes an orphan, VMs and volumes are expunged too.
+func (c *Collector) Delete(orphan *Orphan) error {
+	var async *common.AsyncResponse
+	var err error
+	switch orphan.ResourceType {
+	case tag.ResourceTypeVMInstance:
+		return c.deleteInstance(orphan.UUID)
+	case tag.ResourceTypeVolume:
+		return c.deleteVolume(orphan.UUID)
+	case tag.ResourceTypePortForwardingRule:
+		async, err = c.portForwardingClient.DeleteRule(orphan.UUID)
+	case tag.ResourceTypeEip:
+		async, err = c.eipClient.DeleteEip(orphan.UUID)
+	case tag.ResourceTypeVip:
+		async, err = c.vipClient.DeleteVip(orphan.UUID)
+	case tag.ResourceTypeSecurityGroup:
+		async, err = c.securityGroupClient.DeleteSecurityGroup(orphan.UUID)
+	case tag.ResourceTypeAffinityGroup:
+		async, err = c.affinityGroupClient.DeleteAffinityGroup(orphan.UUID)
+	case tag.ResourceTypeInstanceOffering:
+		async, err = c.offeringClient.DeleteOffering(orphan.UUID)
+	default:
+		return errors.Errorf("Can not delete the %s %s.", orphan.ResourceType, orphan.UUID)
+	}
+	if err == nil {
+		err = finishJob(async, c.Timeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when delete %s %s.", orphan.ResourceType, orphan.UUID)
+	}
+	return nil
+}
+
+func (c *Collector) deleteInstance(uuid string) error {
+	vm, err := c.instanceClient.QueryInstance(uuid)
+	if errors.Cause(err) == instance.ErrInstanceNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query vm instance %s.", uuid)
+	}
+	if vm.State != instance.VMInstanceStateDestroyed {
+		async, err := c.instanceClient.DeleteInstance(uuid)
+		if err == nil {
+			err = finishJob(async, c.Timeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when destroy vm instance %s.", uuid)
+		}
+	}
+	async, err := c.instanceClient.ExpungeInstance(uuid)
+	if err == nil {
+		err = finishJob(async, c.Timeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when expunge vm instance %s.", uuid)
+	}
+	return nil
+}
+
+func (c *Collector) deleteVolume(uuid string) error {
+	volumes, err := c.volumeClient.QueryVolumes(common.NewQueryParams().Eq("uuid", uuid))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query data volume %s.", uuid)
+	}
+	if len(volumes) == 0 {
+		return nil
+	}
+	if volumes[0].Status != volume.VolumeStatusDeleted {
+		async, err := c.volumeClient.DeleteDataVolume(uuid)
+		if err == nil {
+			err = finishJob(async, c.Timeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when delete data volume %s.", uuid)
+		}
+	}
+	async, err := c.volumeClient.ExpungeDataVolume(uuid)
+	if err == nil {
+		err = finishJob(async, c.Timeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when expunge data volume %s.", uuid)
+	}
+	return nil
+}
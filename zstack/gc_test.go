@@ -0,0 +1,96 @@
+package zstack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+)
+
+func TestCollector(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	gone := e.driver(t, map[string]interface{}{
+		"zstack-instance-offering":     "",
+		"zstack-cpu":                   8,
+		"zstack-memory":                "16G",
+		"zstack-create-security-group": true,
+		"zstack-data-disk-size":        "10G",
+	})
+	if err := gone.Create(); err != nil {
+		t.Fatal(err)
+	}
+	live := e.driver(t, nil)
+	live.MachineName = "live"
+	other := e.driver(t, nil)
+	other.StorePath = filepath.Join(e.storePath, "other")
+	for _, dir := range []string{
+		filepath.Join(e.storePath, "machines", "live"),
+		filepath.Join(other.StorePath, "machines", testMachine),
+	} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []*Driver{live, other} {
+		if err := d.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(e.storePath, "machines", testMachine)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &common.Client{}
+	if err := client.InitWithOptions(testAccount, testPassword, e.server.URL, common.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector(client, e.storePath)
+	orphans, err := collector.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ resourceType, uuid string }{
+		{tag.ResourceTypeSecurityGroup, gone.SecurityGroupUUID},
+		{tag.ResourceTypeVMInstance, gone.InstanceUUID},
+		{tag.ResourceTypeVolume, gone.DataVolumeUUIDs[0]},
+	}
+	if len(orphans) != len(want) {
+		t.Fatalf("orphans = %d, want %d", len(orphans), len(want))
+	}
+	for i, w := range want {
+		if orphans[i].ResourceType != w.resourceType || orphans[i].UUID != w.uuid || orphans[i].Machine != testMachine {
+			t.Errorf("orphan %d = %+v, want %s %s of %s", i, orphans[i], w.resourceType, w.uuid, testMachine)
+		}
+	}
+
+	for _, orphan := range orphans {
+		if err := collector.Delete(orphan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.server.VM(gone.InstanceUUID) != nil || e.server.Resource("volumes", gone.DataVolumeUUIDs[0]) != nil {
+		t.Error("the vm or the data volume of the removed machine is left")
+	}
+
+	// the offering is unused once the vm is gone
+	orphans, err = collector.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].UUID != gone.InstanceOfferingUUID || orphans[0].Machine != "" {
+		t.Fatalf("orphans = %+v, want the instance offering %s", orphans, gone.InstanceOfferingUUID)
+	}
+	if err := collector.Delete(orphans[0]); err != nil {
+		t.Fatal(err)
+	}
+	if orphans, err = collector.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("orphans after the cleanup = %+v, %v", orphans, err)
+	}
+	if e.server.VM(live.InstanceUUID) == nil || e.server.VM(other.InstanceUUID) == nil {
+		t.Error("the collector deleted a vm of a live machine or of another store")
+	}
+}
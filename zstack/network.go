@@ -0,0 +1,183 @@
+package zstack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/pkg/errors"
+)
+
+const staticIPTagFormat = "staticIp::%s::%s"
+
+// resolveNetworkRoles picks the default network, which holds the default
+// route, and the address network, whose NIC address the driver reports.
+func (d *Driver) resolveNetworkRoles() error {
+	if d.DefaultL3NetworkUUID == "" {
+		uuid, err := d.resolveMachineNetwork("default", d.DefaultNetwork)
+		if err != nil {
+			return err
+		}
+		d.DefaultL3NetworkUUID = uuid
+	}
+	if d.AddressL3NetworkUUID == "" {
+		if d.AddressNetwork == "" {
+			d.AddressL3NetworkUUID = d.DefaultL3NetworkUUID
+			return nil
+		}
+		uuid, err := d.resolveMachineNetwork("address", d.AddressNetwork)
+		if err != nil {
+			return err
+		}
+		d.AddressL3NetworkUUID = uuid
+	}
+	return nil
+}
+
+// resolveMachineNetwork resolves a network which must be one of the
+// machine's networks. An empty value selects the first network.
+func (d *Driver) resolveMachineNetwork(role, network string) (string, error) {
+	if network == "" {
+		if len(d.L3NetworkUUIDs) == 0 {
+			return "", nil
+		}
+		return d.L3NetworkUUIDs[0], nil
+	}
+	uuid, err := resolveUUID("l3 network", network, d.lookupL3Networks, d.zoneCondition()...)
+	if err != nil {
+		return "", err
+	}
+	if !d.hasL3Network(uuid) {
+		return "", errors.Errorf("The %s network %s is not one of the machine's networks.", role, network)
+	}
+	return uuid, nil
+}
+
+// addressNIC returns the NIC of the VM on the address network, nil if it has
+// none. Machines created before the address network was stored use their
+// first NIC.
+func (d *Driver) addressNIC(inventory *instance.VMInstanceInventory) *instance.VMNic {
+	if d.AddressL3NetworkUUID == "" {
+		if len(inventory.VMNics) == 0 {
+			return nil
+		}
+		return inventory.VMNics[0]
+	}
+	for _, nic := range inventory.VMNics {
+		if nic.L3NetworkUUID == d.AddressL3NetworkUUID {
+			return nic
+		}
+	}
+	return nil
+}
+
+// getIP returns the EIP or the port forwarding VIP of the machine if it has
+// one, otherwise the address of the NIC on the address network.
+func (d *Driver) getIP(inventory *instance.VMInstanceInventory) string {
+	if d.EIPAddress != "" {
+		return d.EIPAddress
+	}
+	if d.PortForwardingAddress != "" {
+		return d.PortForwardingAddress
+	}
+	if nic := d.addressNIC(inventory); nic != nil {
+		return nic.IP
+	}
+	return ""
+}
+
+// resolveStaticIPs parses the --zstack-static-ip entries, "network=ip" or a
+// bare IP for the first network, into L3 network UUID to IP.
+func (d *Driver) resolveStaticIPs() error {
+	if len(d.StaticIPsByL3Network) > 0 || d.StaticIPs == "" {
+		return nil
+	}
+
+	staticIPs := map[string]string{}
+	for _, entry := range splitList(d.StaticIPs) {
+		network, ip := "", entry
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			network, ip = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+
+		var l3UUID string
+		if network == "" {
+			if len(d.L3NetworkUUIDs) == 0 {
+				return errors.Errorf("No network to assign the static IP %s to.", ip)
+			}
+			l3UUID = d.L3NetworkUUIDs[0]
+		} else {
+			var err error
+			if l3UUID, err = resolveUUID("l3 network", network, d.lookupL3Networks, d.zoneCondition()...); err != nil {
+				return err
+			}
+		}
+		if !d.hasL3Network(l3UUID) {
+			return errors.Errorf("The static IP %s is for l3 network %s, which the machine is not attached to.", ip, network)
+		}
+		if _, ok := staticIPs[l3UUID]; ok {
+			return errors.Errorf("More than one static IP is set for l3 network %s.", l3UUID)
+		}
+		staticIPs[l3UUID] = ip
+	}
+
+	d.StaticIPsByL3Network = staticIPs
+	return nil
+}
+
+// checkStaticIPs makes sure every static IP is in the IP ranges of its L3
+// network and not used yet, so conflicts are reported before the VM is
+// created.
+func (d *Driver) checkStaticIPs() error {
+	for _, l3UUID := range d.L3NetworkUUIDs {
+		ip, ok := d.StaticIPsByL3Network[l3UUID]
+		if !ok {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return errors.Errorf("Invalid static IP %q.", ip)
+		}
+
+		networks, err := d.l3NetworkClient.QueryL3Networks(common.NewQueryParams().Eq("uuid", l3UUID))
+		if err != nil {
+			return errors.Wrapf(err, "Get error when query l3 network %s.", l3UUID)
+		}
+		if len(networks) == 0 {
+			return errors.Errorf("l3 network %s not found", l3UUID)
+		}
+		if !networks[0].Contains(parsed) {
+			return errors.Errorf("The static IP %s is out of the IP ranges of l3 network %s.", ip, networks[0].Name)
+		}
+
+		availability, err := d.l3NetworkClient.CheckIPAvailability(l3UUID, ip)
+		if err != nil {
+			return errors.Wrapf(err, "Get error when check the availability of ip %s.", ip)
+		}
+		if !availability.Available {
+			return errors.Errorf("The static IP %s is not available in l3 network %s: %s", ip, networks[0].Name, availability.Reason)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) staticIPTags() []string {
+	var tags []string
+	for _, l3UUID := range d.L3NetworkUUIDs {
+		if ip, ok := d.StaticIPsByL3Network[l3UUID]; ok {
+			tags = append(tags, fmt.Sprintf(staticIPTagFormat, l3UUID, ip))
+		}
+	}
+	return tags
+}
+
+func (d *Driver) hasL3Network(l3UUID string) bool {
+	for _, uuid := range d.L3NetworkUUIDs {
+		if uuid == l3UUID {
+			return true
+		}
+	}
+	return false
+}
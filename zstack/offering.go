@@ -0,0 +1,122 @@
+package zstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const instanceOfferingTypeUserVM = "UserVm"
+
+// parseMemory parses a memory size such as 512M or 4G; a bare number is in
+// MiB.
+func parseMemory(memory string) (int64, error) {
+	value := strings.TrimSpace(memory)
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+		return n * mib, nil
+	}
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, errors.Errorf("Invalid memory size %q, expect e.g. 512M or 4G, or a number of MiB.", memory)
+	}
+	return size, nil
+}
+
+// resolveInstanceOfferingSpec reuses an enabled instance offering with the
+// requested CPU and memory. Create makes a new one when there is none.
+func (d *Driver) resolveInstanceOfferingSpec() error {
+	if d.InstanceOfferingUUID != "" || d.CPU == 0 {
+		return nil
+	}
+	memory, err := parseMemory(d.Memory)
+	if err != nil {
+		return err
+	}
+	offerings, err := d.queryOfferingsBySpec(memory)
+	if err != nil {
+		return err
+	}
+	if len(offerings) > 0 {
+		log.Debugf("Use instance offering %s for %d CPUs and %d MiB memory", offerings[0].UUID, d.CPU, memory/mib)
+		d.InstanceOfferingUUID = offerings[0].UUID
+	}
+	return nil
+}
+
+// queryOfferingsBySpec returns the enabled instance offerings with the
+// requested CPU and memory, the oldest first.
+func (d *Driver) queryOfferingsBySpec(memory int64) ([]*instance.OfferingInventory, error) {
+	params := common.NewQueryParams().
+		Eq("cpuNum", strconv.Itoa(d.CPU)).
+		Eq("memorySize", strconv.FormatInt(memory, 10)).
+		Eq("type", instanceOfferingTypeUserVM).
+		Eq("state", "Enabled").
+		SortBy("createDate", true).
+		SetFields("uuid", "name")
+	offerings, err := d.instanceOfferingClient.QueryOfferings(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get error when query instance offerings.")
+	}
+	return offerings, nil
+}
+
+// createInstanceOffering creates the instance offering for the requested
+// CPU and memory. It is shared by later machines of the same size, so
+// Remove keeps it.
+func (d *Driver) createInstanceOffering() error {
+	if d.InstanceOfferingUUID != "" {
+		return nil
+	}
+	memory, err := parseMemory(d.Memory)
+	if err != nil {
+		return err
+	}
+
+	request := instance.CreateOfferingRequest{}
+	request.Params.Name = fmt.Sprintf("docker-machine-%dc-%dm", d.CPU, memory/mib)
+	request.Params.Description = "Created by docker-machine"
+	request.Params.CPUNum = d.CPU
+	request.Params.MemorySize = memory
+	request.Params.Type = instanceOfferingTypeUserVM
+	request.UserTags = d.sharedTags()
+	async, err := d.instanceOfferingClient.CreateOffering(request)
+	if err != nil {
+		return errors.Wrap(err, "Get error when create instance offering in zstack.")
+	}
+	response := instance.OfferingResponse{}
+	if err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when create instance offering in zstack.")
+	}
+	if response.Error != nil {
+		return errors.Wrap(response.Error.WrapError(), "Get error when create instance offering in zstack.")
+	}
+	created := response.Inventory.UUID
+	log.Infof("Created instance offering %s with %d CPUs and %d MiB memory", response.Inventory.Name, d.CPU, memory/mib)
+
+	// machines created in parallel may each have created an offering, they
+	// all settle on the oldest one
+	offerings, err := d.queryOfferingsBySpec(memory)
+	if err != nil {
+		return err
+	}
+	if len(offerings) == 0 {
+		return errors.Errorf("instance offering %s not found after creating it", created)
+	}
+	if offerings[0].UUID != created {
+		async, err := d.instanceOfferingClient.DeleteOffering(created)
+		if err == nil {
+			err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when delete zstack instance offering %s.", created)
+		}
+		log.Infof("Use the older instance offering %s instead", offerings[0].UUID)
+	}
+	d.InstanceOfferingUUID = offerings[0].UUID
+	return nil
+}
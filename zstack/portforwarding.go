@@ -0,0 +1,171 @@
+package zstack
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/portforwarding"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPortForwardingRange = "20000-29999"
+
+	// another machine may take a port between the query and the creation
+	portForwardingAttempts = 5
+)
+
+func parsePortRange(value string) (int, int, error) {
+	if value == "" {
+		value = defaultPortForwardingRange
+	}
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("Invalid port range %q, expect start-end.", value)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Errorf("Invalid port range %q, bad port %q.", value, parts[0])
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, errors.Errorf("Invalid port range %q, bad port %q.", value, parts[1])
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, errors.Errorf("Invalid port range %q.", value)
+	}
+	return start, end, nil
+}
+
+// createPortForwarding maps a free public port of the shared VIP to the
+// SSH port and another to the Docker port of the VM.
+func (d *Driver) createPortForwarding(inventory *instance.VMInstanceInventory) error {
+	if d.PortForwardingVIPUUID == "" {
+		return nil
+	}
+
+	nic := d.addressNIC(inventory)
+	if nic == nil {
+		return errors.Errorf("The instance %s has no nic on l3 network %s to forward ports to.", d.InstanceUUID, d.AddressL3NetworkUUID)
+	}
+
+	vips, err := d.vipClient.QueryVips(common.NewQueryParams().Eq("uuid", d.PortForwardingVIPUUID))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query vip %s.", d.PortForwardingVIPUUID)
+	}
+	if len(vips) == 0 {
+		return errors.Errorf("vip %s not found", d.PortForwardingVIPUUID)
+	}
+
+	sshPort, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return err
+	}
+	if d.SSHForwardPort, err = d.forwardPort("ssh", nic.UUID, sshPort); err != nil {
+		return err
+	}
+	if d.DockerForwardPort, err = d.forwardPort("docker", nic.UUID, dockerPort); err != nil {
+		return err
+	}
+
+	d.PortForwardingAddress = vips[0].IP
+	log.Infof("Forwarded %s:%d to SSH and %s:%d to Docker of instance %s",
+		d.PortForwardingAddress, d.SSHForwardPort, d.PortForwardingAddress, d.DockerForwardPort, d.InstanceUUID)
+	return nil
+}
+
+// forwardPort creates a rule from a free VIP port to privatePort and
+// returns the VIP port.
+func (d *Driver) forwardPort(name, nicUUID string, privatePort int) (int, error) {
+	start, end, err := parsePortRange(d.PortForwardingRange)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < portForwardingAttempts; attempt++ {
+		port, err := d.freeVipPort(start, end)
+		if err != nil {
+			return 0, err
+		}
+
+		request := portforwarding.CreateRuleRequest{}
+		request.Params.Name = d.MachineName + "-" + name
+		request.Params.VipUUID = d.PortForwardingVIPUUID
+		request.Params.VipPortStart = port
+		request.Params.VipPortEnd = port
+		request.Params.PrivatePortStart = privatePort
+		request.Params.PrivatePortEnd = privatePort
+		request.Params.ProtocolType = portforwarding.ProtocolTCP
+		request.Params.VMNicUUID = nicUUID
+		request.UserTags = d.ownerTags()
+		async, err := d.portForwardingClient.CreateRule(request)
+		if err != nil {
+			return 0, errors.Wrap(err, "Get error when create port forwarding rule in zstack.")
+		}
+		response := portforwarding.Response{}
+		err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout)
+		if err == nil && response.Error != nil {
+			err = response.Error.WrapError()
+		}
+		if err == nil {
+			d.PortForwardingRuleUUIDs = append(d.PortForwardingRuleUUIDs, response.Inventory.UUID)
+			return port, nil
+		}
+		log.Debugf("Failed to forward vip port %d, retrying: %v", port, err)
+		lastErr = err
+	}
+	return 0, errors.Wrap(lastErr, "Get error when create port forwarding rule in zstack.")
+}
+
+// freeVipPort returns the lowest port in the range not used by any rule of
+// the shared VIP.
+func (d *Driver) freeVipPort(start, end int) (int, error) {
+	rules, err := d.portForwardingClient.QueryRules(common.NewQueryParams().Eq("vipUuid", d.PortForwardingVIPUUID))
+	if err != nil {
+		return 0, errors.Wrap(err, "Get error when query port forwarding rules.")
+	}
+	used := map[int]bool{}
+	for _, rule := range rules {
+		for port := rule.VipPortStart; port <= rule.VipPortEnd; port++ {
+			used[port] = true
+		}
+	}
+	for port := start; port <= end; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, errors.Errorf("No free port left in %d-%d of vip %s.", start, end, d.PortForwardingVIPUUID)
+}
+
+// removePortForwarding deletes the rules of the machine, the shared VIP is
+// kept. Rules which could not be deleted stay recorded.
+func (d *Driver) removePortForwarding(summary *removeSummary) {
+	var left []string
+	for _, uuid := range d.PortForwardingRuleUUIDs {
+		uuid := uuid
+		if !d.deleteIfExists(summary, "port forwarding rule", uuid, func() (int, error) {
+			rules, err := d.portForwardingClient.QueryRules(common.NewQueryParams().Eq("uuid", uuid))
+			return len(rules), err
+		}, d.portForwardingClient.DeleteRule) {
+			left = append(left, uuid)
+		}
+	}
+	d.PortForwardingRuleUUIDs = left
+}
+
+func (d *Driver) lookupVips(params *common.QueryParams) ([]resource, error) {
+	vips, err := d.vipClient.QueryVips(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(vips))
+	for _, v := range vips {
+		found = append(found, resource{UUID: v.UUID, Name: v.Name})
+	}
+	return found, nil
+}
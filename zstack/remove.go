@@ -0,0 +1,169 @@
+package zstack
+
+import (
+	"fmt"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	resultRemoved = "removed"
+	resultGone    = "already gone"
+)
+
+// removeSummary collects what Remove did with every resource of the
+// machine, so one failure does not hide the others.
+type removeSummary struct {
+	results []string
+	failed  int
+}
+
+func (s *removeSummary) record(kind, uuid, result string) {
+	s.results = append(s.results, fmt.Sprintf("%s %s: %s", kind, uuid, result))
+}
+
+func (s *removeSummary) fail(kind, uuid string, err error) {
+	s.record(kind, uuid, "failed: "+err.Error())
+	s.failed++
+}
+
+// report logs the summary and fails if any resource is left.
+func (s *removeSummary) report(machine string) error {
+	for _, result := range s.results {
+		log.Infof("%s | %s", machine, result)
+	}
+	if s.failed > 0 {
+		return errors.Errorf("Failed to remove %d of the %d resources of machine %s, removing it again retries them.",
+			s.failed, len(s.results), machine)
+	}
+	return nil
+}
+
+// deleteIfExists deletes a resource unless count finds it gone already, and
+// reports whether the resource no longer exists.
+func (d *Driver) deleteIfExists(summary *removeSummary, kind, uuid string,
+	count func() (int, error), remove func(string) (*common.AsyncResponse, error)) bool {
+	n, err := count()
+	if err != nil {
+		summary.fail(kind, uuid, errors.Wrapf(err, "Get error when query %s %s.", kind, uuid))
+		return false
+	}
+	if n == 0 {
+		summary.record(kind, uuid, resultGone)
+		return true
+	}
+
+	async, err := remove(uuid)
+	if err == nil {
+		err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		summary.fail(kind, uuid, errors.Wrapf(err, "Get error when delete %s %s.", kind, uuid))
+		return false
+	}
+	summary.record(kind, uuid, resultRemoved)
+	return true
+}
+
+// removeInstance destroys and expunges the VM. A destroyed VM is only
+// expunged. Without a recorded VM it removes the VM which carries the tags of
+// this machine, like the one of a create which timed out but finished later.
+func (d *Driver) removeInstance(summary *removeSummary) bool {
+	if d.InstanceUUID == "" {
+		uuid, err := d.findTaggedInstance()
+		if err != nil {
+			summary.fail("vm instance", d.MachineName, err)
+			return false
+		}
+		if uuid == "" {
+			return true
+		}
+		log.Infof("%s | Found vm instance %s by its tags", d.MachineName, uuid)
+		d.InstanceUUID = uuid
+	}
+	vm, err := d.instanceClient.QueryInstance(d.InstanceUUID)
+	if errors.Cause(err) == instance.ErrInstanceNotFound {
+		summary.record("vm instance", d.InstanceUUID, resultGone)
+		return true
+	}
+	if err != nil {
+		summary.fail("vm instance", d.InstanceUUID, errors.Wrap(err, "Get error when query the vm instance."))
+		return false
+	}
+	if err := d.trackOwnedDataVolumes(vm); err != nil {
+		summary.fail("vm instance", d.InstanceUUID, err)
+		return false
+	}
+
+	if vm.State != instance.VMInstanceStateDestroyed {
+		async, err := d.instanceClient.DeleteInstance(d.InstanceUUID)
+		if err == nil {
+			err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			summary.fail("vm instance", d.InstanceUUID, errors.Wrap(err, "Get error when delete zstack instance."))
+			return false
+		}
+	}
+	async, err := d.instanceClient.ExpungeInstance(d.InstanceUUID)
+	if err == nil {
+		err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		summary.fail("vm instance", d.InstanceUUID, errors.Wrap(err, "Get error when expunge zstack instance."))
+		return false
+	}
+	summary.record("vm instance", d.InstanceUUID, resultRemoved)
+	return true
+}
+
+// findTaggedInstance returns the VM which carries the tags of this machine,
+// or "" if there is none.
+func (d *Driver) findTaggedInstance() (string, error) {
+	owner := d.machineTags()
+	tags, err := d.tagClient.QueryUserTags(common.NewQueryParams().
+		Eq("resourceType", tag.ResourceTypeVMInstance).In("tag", owner...).SortBy("createDate", true))
+	if err != nil {
+		return "", errors.Wrap(err, "Get error when query the vm instance by its tags.")
+	}
+	found := map[string]int{}
+	var uuids []string
+	for _, t := range tags {
+		found[t.ResourceUUID]++
+		if found[t.ResourceUUID] == len(owner) {
+			uuids = append(uuids, t.ResourceUUID)
+		}
+	}
+	if len(uuids) == 0 {
+		return "", nil
+	}
+	if len(uuids) > 1 {
+		log.Warnf("%s | Found %d vm instances with the tags of the machine, removing %s", d.MachineName, len(uuids), uuids[0])
+	}
+	return uuids[0], nil
+}
+
+// trackOwnedDataVolumes adds the data volumes of the VM which carry the
+// tags of this machine, for machines created before the volumes were
+// recorded. Volumes attached by hand are left alone.
+func (d *Driver) trackOwnedDataVolumes(vm *instance.VMInstanceInventory) error {
+	owner := d.machineTags()
+	for _, v := range vm.AllVolumes {
+		if v.Type != volume.VolumeTypeData {
+			continue
+		}
+		tags, err := d.tagClient.QueryUserTags(common.NewQueryParams().Eq("resourceUuid", v.UUID).In("tag", owner...))
+		if err != nil {
+			return errors.Wrapf(err, "Get error when query the tags of data volume %s.", v.UUID)
+		}
+		if len(tags) == len(owner) {
+			d.trackDataVolume(v.UUID)
+		}
+	}
+	return nil
+}
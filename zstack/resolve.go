@@ -0,0 +1,283 @@
+package zstack
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// ZStack UUIDs are 32 lower case hex digits without dashes.
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type resource struct {
+	UUID string
+	Name string
+}
+
+type lookupFunc func(params *common.QueryParams) ([]resource, error)
+
+func isUUID(value string) bool {
+	return uuidPattern.MatchString(value)
+}
+
+// resolveUUID returns the UUID of the resource identified by value, which may
+// be either a UUID or a resource name. Extra conditions narrow the lookup,
+// e.g. to a zone or cluster.
+func resolveUUID(kind, value string, lookup lookupFunc, conditions ...string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	if isUUID(value) {
+		found, err := lookup(lookupParams(conditions).Eq("uuid", value))
+		if err != nil {
+			return "", errors.Wrapf(err, "Get error when query %s %s.", kind, value)
+		}
+		if len(found) == 1 {
+			return found[0].UUID, nil
+		}
+	}
+
+	found, err := lookup(lookupParams(conditions).Eq("name", value))
+	if err != nil {
+		return "", errors.Wrapf(err, "Get error when query %s %s.", kind, value)
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.Errorf("%s %q not found", kind, value)
+	case 1:
+		log.Debugf("Resolved %s %q to %s", kind, value, found[0].UUID)
+		return found[0].UUID, nil
+	}
+
+	uuids := make([]string, 0, len(found))
+	for _, r := range found {
+		uuids = append(uuids, r.UUID)
+	}
+	return "", errors.Errorf("%s name %q is ambiguous, it matches %s; use the UUID instead",
+		kind, value, strings.Join(uuids, ", "))
+}
+
+// resolveUUIDs resolves a comma separated list of names or UUIDs.
+func resolveUUIDs(kind, values string, lookup lookupFunc, conditions ...string) ([]string, error) {
+	var uuids []string
+	for _, value := range splitList(values) {
+		uuid, err := resolveUUID(kind, value, lookup, conditions...)
+		if err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, nil
+}
+
+func lookupParams(conditions []string) *common.QueryParams {
+	return common.NewQueryParams().Where(conditions...).SetFields("uuid", "name")
+}
+
+func splitList(values string) []string {
+	var list []string
+	for _, t := range strings.Split(values, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// resolveResources translates every placement and resource flag into the
+// UUID ZStack expects. Values resolved before are kept, so a machine never
+// changes its resources once they are stored in its config.
+func (d *Driver) resolveResources() error {
+	var err error
+
+	if d.ZoneUUID == "" {
+		if d.ZoneUUID, err = resolveUUID("zone", d.ZoneName, d.lookupZones); err != nil {
+			return err
+		}
+	}
+	if d.ClusterUUID == "" {
+		if d.ClusterUUID, err = resolveUUID("cluster", d.ClusterName, d.lookupClusters, d.zoneCondition()...); err != nil {
+			return err
+		}
+	}
+	if d.PhysicalHostUUID == "" {
+		var conditions []string
+		if d.ClusterUUID != "" {
+			conditions = append(conditions, "clusterUuid="+d.ClusterUUID)
+		} else {
+			conditions = d.zoneCondition()
+		}
+		if d.PhysicalHostUUID, err = resolveUUID("host", d.PhysicalHost, d.lookupHosts, conditions...); err != nil {
+			return err
+		}
+	}
+	if d.PrimaryStorageUUID == "" {
+		if d.PrimaryStorageUUID, err = resolveUUID("primary storage", d.PrimaryStorage, d.lookupPrimaryStorages, d.zoneCondition()...); err != nil {
+			return err
+		}
+	}
+	if d.ImageUUID == "" {
+		if d.ImageUUID, err = resolveUUID("image", d.ImageName, d.lookupImages); err != nil {
+			return err
+		}
+	}
+	if d.InstanceOfferingUUID == "" {
+		if d.InstanceOfferingUUID, err = resolveUUID("instance offering", d.InstanceOffering, d.lookupInstanceOfferings); err != nil {
+			return err
+		}
+	}
+	if err = d.resolveInstanceOfferingSpec(); err != nil {
+		return err
+	}
+	if d.SystemDiskOfferingUUID == "" {
+		if d.SystemDiskOfferingUUID, err = resolveUUID("disk offering", d.SystemDiskOffering, d.lookupDiskOfferings); err != nil {
+			return err
+		}
+	}
+	if len(d.DataDiskOfferingUUIDs) == 0 {
+		if d.DataDiskOfferingUUIDs, err = resolveUUIDs("disk offering", d.DataDiskOffering, d.lookupDiskOfferings); err != nil {
+			return err
+		}
+	}
+	if d.DataDiskPrimaryStorageUUID == "" {
+		if d.DataDiskPrimaryStorageUUID, err = resolveUUID("primary storage", d.DataDiskPrimaryStorage, d.lookupPrimaryStorages, d.zoneCondition()...); err != nil {
+			return err
+		}
+	}
+	if err = d.resolveDataDiskSizes(); err != nil {
+		return err
+	}
+	if len(d.L3NetworkUUIDs) == 0 {
+		if d.L3NetworkUUIDs, err = resolveUUIDs("l3 network", d.L3NetworkNames, d.lookupL3Networks, d.zoneCondition()...); err != nil {
+			return err
+		}
+	}
+	if d.EIPNetworkUUID == "" {
+		if d.EIPNetworkUUID, err = resolveUUID("l3 network", d.EIPNetwork, d.lookupL3Networks, d.zoneCondition()...); err != nil {
+			return err
+		}
+	}
+	if d.PortForwardingVIPUUID == "" {
+		if d.PortForwardingVIPUUID, err = resolveUUID("vip", d.PortForwardingVIP, d.lookupVips); err != nil {
+			return err
+		}
+	}
+	if len(d.SecurityGroupUUIDs) == 0 {
+		if d.SecurityGroupUUIDs, err = resolveUUIDs("security group", d.SecurityGroups, d.lookupSecurityGroups); err != nil {
+			return err
+		}
+	}
+	if err = d.resolveNetworkRoles(); err != nil {
+		return err
+	}
+	return d.resolveStaticIPs()
+}
+
+func (d *Driver) zoneCondition() []string {
+	if d.ZoneUUID == "" {
+		return nil
+	}
+	return []string{"zoneUuid=" + d.ZoneUUID}
+}
+
+func (d *Driver) lookupZones(params *common.QueryParams) ([]resource, error) {
+	zones, err := d.zoneCLient.QueryZones(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(zones))
+	for _, z := range zones {
+		found = append(found, resource{UUID: z.UUID, Name: z.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupClusters(params *common.QueryParams) ([]resource, error) {
+	clusters, err := d.clusterClient.QueryClusters(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(clusters))
+	for _, c := range clusters {
+		found = append(found, resource{UUID: c.UUID, Name: c.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupHosts(params *common.QueryParams) ([]resource, error) {
+	hosts, err := d.hostClient.QueryHosts(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(hosts))
+	for _, h := range hosts {
+		found = append(found, resource{UUID: h.UUID, Name: h.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupPrimaryStorages(params *common.QueryParams) ([]resource, error) {
+	storages, err := d.primaryStorageClient.QueryPrimaryStorages(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(storages))
+	for _, s := range storages {
+		found = append(found, resource{UUID: s.UUID, Name: s.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupImages(params *common.QueryParams) ([]resource, error) {
+	images, err := d.imageClient.QueryImages(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(images))
+	for _, i := range images {
+		found = append(found, resource{UUID: i.UUID, Name: i.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupInstanceOfferings(params *common.QueryParams) ([]resource, error) {
+	offerings, err := d.instanceOfferingClient.QueryOfferings(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(offerings))
+	for _, o := range offerings {
+		found = append(found, resource{UUID: o.UUID, Name: o.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupDiskOfferings(params *common.QueryParams) ([]resource, error) {
+	offerings, err := d.volumeOfferingClient.QueryDiskOfferings(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(offerings))
+	for _, o := range offerings {
+		found = append(found, resource{UUID: o.UUID, Name: o.Name})
+	}
+	return found, nil
+}
+
+func (d *Driver) lookupL3Networks(params *common.QueryParams) ([]resource, error) {
+	networks, err := d.l3NetworkClient.QueryL3Networks(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(networks))
+	for _, n := range networks {
+		found = append(found, resource{UUID: n.UUID, Name: n.Name})
+	}
+	return found, nil
+}
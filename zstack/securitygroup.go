@@ -0,0 +1,208 @@
+package zstack
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/securitygroup"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const defaultSecurityGroupCIDR = "0.0.0.0/0"
+
+// parseSecurityGroupRules parses comma separated [protocol:]port[-port][@cidr]
+// entries, e.g. "80,udp:8000-8100@10.0.0.0/8", into ingress rules.
+func parseSecurityGroupRules(value, defaultCIDR string) ([]*securitygroup.Rule, error) {
+	var rules []*securitygroup.Rule
+	for _, entry := range splitList(value) {
+		rule := &securitygroup.Rule{
+			Type:        securitygroup.RuleTypeIngress,
+			Protocol:    securitygroup.ProtocolTCP,
+			AllowedCidr: defaultCIDR,
+		}
+
+		ports := entry
+		if i := strings.Index(ports, "@"); i >= 0 {
+			ports, rule.AllowedCidr = ports[:i], ports[i+1:]
+		}
+		if i := strings.Index(ports, ":"); i >= 0 {
+			rule.Protocol, ports = strings.ToUpper(ports[:i]), ports[i+1:]
+		}
+		if rule.Protocol != securitygroup.ProtocolTCP && rule.Protocol != securitygroup.ProtocolUDP {
+			return nil, errors.Errorf("Invalid security group rule %q, the protocol must be tcp or udp.", entry)
+		}
+
+		start, end := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			start, end = ports[:i], ports[i+1:]
+		}
+		var err error
+		if rule.StartPort, err = strconv.Atoi(start); err != nil {
+			return nil, errors.Errorf("Invalid security group rule %q, bad port %q.", entry, start)
+		}
+		if rule.EndPort, err = strconv.Atoi(end); err != nil {
+			return nil, errors.Errorf("Invalid security group rule %q, bad port %q.", entry, end)
+		}
+		if rule.StartPort < 1 || rule.EndPort > 65535 || rule.StartPort > rule.EndPort {
+			return nil, errors.Errorf("Invalid security group rule %q, bad port range.", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// machineSecurityGroupRules opens SSH, Docker TLS and the user ports.
+func (d *Driver) machineSecurityGroupRules() ([]*securitygroup.Rule, error) {
+	cidr := d.SecurityGroupCIDR
+	if cidr == "" {
+		cidr = defaultSecurityGroupCIDR
+	}
+	sshPort, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseSecurityGroupRules(strconv.Itoa(sshPort)+","+strconv.Itoa(dockerPort), cidr)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := parseSecurityGroupRules(d.SecurityGroupRules, cidr)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, extra...), nil
+}
+
+// checkSecurityGroups requires the security groups given by the user to be
+// attached to the address network already, the driver does not change the
+// networks of groups it did not create.
+func (d *Driver) checkSecurityGroups() error {
+	for _, uuid := range d.SecurityGroupUUIDs {
+		group, err := d.querySecurityGroup(uuid)
+		if err != nil {
+			return err
+		}
+		if !group.AttachedTo(d.AddressL3NetworkUUID) {
+			return errors.Errorf("The security group %s is not attached to the l3 network %s of the machine address, attach it first.",
+				uuid, d.AddressL3NetworkUUID)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) querySecurityGroup(uuid string) (*securitygroup.SecurityGroupInventory, error) {
+	found, err := d.securityGroupClient.QuerySecurityGroups(common.NewQueryParams().Eq("uuid", uuid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get error when query security group %s.", uuid)
+	}
+	if len(found) == 0 {
+		return nil, errors.Errorf("security group %s not found", uuid)
+	}
+	return found[0], nil
+}
+
+// applySecurityGroups creates the per-machine security group when asked
+// and adds the NIC on the address network to every security group.
+func (d *Driver) applySecurityGroups(inventory *instance.VMInstanceInventory) error {
+	if !d.CreateSecurityGroup && len(d.SecurityGroupUUIDs) == 0 {
+		return nil
+	}
+
+	nic := d.addressNIC(inventory)
+	if nic == nil {
+		return errors.Errorf("The instance %s has no nic on l3 network %s to apply security groups to.", d.InstanceUUID, d.AddressL3NetworkUUID)
+	}
+
+	groups := append([]string(nil), d.SecurityGroupUUIDs...)
+	if d.CreateSecurityGroup && d.SecurityGroupUUID == "" {
+		if err := d.createSecurityGroup(); err != nil {
+			return err
+		}
+	}
+	if d.SecurityGroupUUID != "" {
+		group, err := d.querySecurityGroup(d.SecurityGroupUUID)
+		if err != nil {
+			return err
+		}
+		if !group.AttachedTo(d.AddressL3NetworkUUID) {
+			async, err := d.securityGroupClient.AttachL3Network(d.SecurityGroupUUID, d.AddressL3NetworkUUID)
+			if err == nil {
+				err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Get error when attach security group %s to l3 network.", d.SecurityGroupUUID)
+			}
+		}
+		groups = append(groups, d.SecurityGroupUUID)
+	}
+
+	for _, uuid := range groups {
+		async, err := d.securityGroupClient.AddVMNics(uuid, []string{nic.UUID})
+		if err == nil {
+			err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when add the vm nic to security group %s.", uuid)
+		}
+		log.Infof("Added instance %s to security group %s", d.InstanceUUID, uuid)
+	}
+	return nil
+}
+
+func (d *Driver) createSecurityGroup() error {
+	rules, err := d.machineSecurityGroupRules()
+	if err != nil {
+		return err
+	}
+
+	request := securitygroup.CreateSecurityGroupRequest{}
+	request.Params.Name = d.MachineName
+	request.Params.Description = "Created by docker-machine for " + d.MachineName
+	request.UserTags = d.ownerTags()
+	async, err := d.securityGroupClient.CreateSecurityGroup(request)
+	if err != nil {
+		return errors.Wrap(err, "Get error when create security group in zstack.")
+	}
+	response := securitygroup.Response{}
+	if err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when create security group in zstack.")
+	}
+	if response.Error != nil {
+		return errors.Wrap(response.Error.WrapError(), "Get error when create security group in zstack.")
+	}
+	d.SecurityGroupUUID = response.Inventory.UUID
+
+	async, err = d.securityGroupClient.AddRules(d.SecurityGroupUUID, rules)
+	if err == nil {
+		err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Get error when add rules to the security group.")
+	}
+	return nil
+}
+
+// removeSecurityGroup deletes the per-machine security group. Groups which
+// were only attached are left alone.
+func (d *Driver) removeSecurityGroup(summary *removeSummary) {
+	if d.SecurityGroupUUID != "" && d.deleteIfExists(summary, "security group", d.SecurityGroupUUID, func() (int, error) {
+		groups, err := d.securityGroupClient.QuerySecurityGroups(common.NewQueryParams().Eq("uuid", d.SecurityGroupUUID))
+		return len(groups), err
+	}, d.securityGroupClient.DeleteSecurityGroup) {
+		d.SecurityGroupUUID = ""
+	}
+}
+
+func (d *Driver) lookupSecurityGroups(params *common.QueryParams) ([]resource, error) {
+	groups, err := d.securityGroupClient.QuerySecurityGroups(params)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]resource, 0, len(groups))
+	for _, g := range groups {
+		found = append(found, resource{UUID: g.UUID, Name: g.Name})
+	}
+	return found, nil
+}
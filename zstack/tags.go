@@ -0,0 +1,103 @@
+package zstack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ownerTag marks every resource created by the driver
+	ownerTag = "docker-machine"
+
+	machineTagPrefix = "docker-machine::machine::"
+	driverTagPrefix  = "docker-machine::driver::"
+	storeTagPrefix   = "docker-machine::store::"
+)
+
+// Version is the driver version recorded on the resources, it is set by the
+// build.
+var Version = "dev"
+
+// parseUserTags parses comma separated key=value pairs into key::value user
+// tags.
+func parseUserTags(value string) ([]string, error) {
+	var tags []string
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.Contains(key, "::") {
+			return nil, errors.Errorf("Invalid tag %q, expect key=value.", entry)
+		}
+		tags = append(tags, key+"::"+strings.TrimSpace(parts[1]))
+	}
+	return tags, nil
+}
+
+// storeHash identifies the docker-machine store without exposing its path.
+func storeHash(storePath string) string {
+	sum := sha256.Sum256([]byte(storePath))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// sharedTags are the tags of resources which later machines of the same
+// store reuse, like instance offerings and affinity groups.
+func (d *Driver) sharedTags() []string {
+	return []string{ownerTag, driverTagPrefix + Version, storeTagPrefix + storeHash(d.StorePath)}
+}
+
+// ownerTags are the tags of the VM and the resources created for it alone.
+func (d *Driver) ownerTags() []string {
+	tags := append(d.sharedTags(), machineTagPrefix+d.MachineName)
+	// validated by SetConfigFromFlags
+	custom, _ := parseUserTags(d.UserTags)
+	return append(tags, custom...)
+}
+
+// machineTags are the tags which tell the resources of this machine apart
+// from those of a machine of the same name in another store.
+func (d *Driver) machineTags() []string {
+	return []string{machineTagPrefix + d.MachineName, storeTagPrefix + storeHash(d.StorePath)}
+}
+
+// tagResource adds the owner tags to a resource which ZStack created
+// without them, like the data volumes of disk offerings.
+func (d *Driver) tagResource(resourceType, uuid string) error {
+	existing, err := d.tagClient.QueryUserTags(common.NewQueryParams().Eq("resourceUuid", uuid))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query the tags of %s.", uuid)
+	}
+	tagged := map[string]bool{}
+	for _, t := range existing {
+		tagged[t.Tag] = true
+	}
+
+	for _, t := range d.ownerTags() {
+		if tagged[t] {
+			continue
+		}
+		async, err := d.tagClient.CreateUserTag(resourceType, uuid, t)
+		if err == nil {
+			err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when tag %s.", uuid)
+		}
+	}
+	log.Debugf("Tagged %s %s", resourceType, uuid)
+	return nil
+}
+
+// createdByStore reports whether a shared resource was created by a machine
+// of this store, which may then delete it.
+func (d *Driver) createdByStore(uuid string) (bool, error) {
+	tags, err := d.tagClient.QueryUserTags(common.NewQueryParams().Eq("resourceUuid", uuid).Eq("tag", storeTagPrefix+storeHash(d.StorePath)))
+	if err != nil {
+		return false, errors.Wrapf(err, "Get error when query the tags of %s.", uuid)
+	}
+	return len(tags) > 0, nil
+}
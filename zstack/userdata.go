@@ -0,0 +1,121 @@
+package zstack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	userDataTagPrefix = "userdata::"
+
+	cloudConfigHeader = "#cloud-config"
+	shellScriptHeader = "#!"
+
+	// The driver part is merged into the user's cloud-config instead of
+	// replacing its users or keys.
+	cloudConfigMergeType = "list(append)+dict(recurse_array)+str()"
+)
+
+// readFlagContent returns the content of a flag which is either a file path
+// or the content itself, like --zstack-userdata.
+func readFlagContent(kind, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		content, err := ioutil.ReadFile(value)
+		if err != nil {
+			return "", errors.Wrapf(err, "Get error when read %s file %s.", kind, value)
+		}
+		return string(content), nil
+	}
+	return value, nil
+}
+
+func userDataContentType(userData string) (string, error) {
+	trimmed := strings.TrimLeft(userData, " \t\r\n")
+	switch {
+	case strings.HasPrefix(trimmed, cloudConfigHeader):
+		return "text/cloud-config", nil
+	case strings.HasPrefix(trimmed, shellScriptHeader):
+		return "text/x-shellscript", nil
+	}
+	return "", errors.Errorf("The user data must be a cloud-config starting with %q or a shell script starting with %q.",
+		cloudConfigHeader, shellScriptHeader)
+}
+
+// driverCloudConfig makes the SSH user the default user of cloud-init,
+// which installs the public key of the sshkey system tag for it.
+func (d *Driver) driverCloudConfig() string {
+	user := d.GetSSHUsername()
+
+	config := cloudConfigHeader + "\n"
+	if user == "root" {
+		return config + "disable_root: false\n"
+	}
+	config += "system_info:\n  default_user:\n"
+	config += fmt.Sprintf("    name: %s\n", user)
+	config += "    sudo: ALL=(ALL) NOPASSWD:ALL\n"
+	config += "    shell: /bin/bash\n"
+	return config
+}
+
+type userDataPart struct {
+	contentType string
+	content     string
+}
+
+// buildUserData merges the driver cloud-config with the user's own data
+// into a multipart cloud-init document.
+func (d *Driver) buildUserData() (string, error) {
+	parts := []userDataPart{{"text/cloud-config", d.driverCloudConfig()}}
+	if d.UserData != "" {
+		contentType, err := userDataContentType(d.UserData)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, userDataPart{contentType, d.UserData})
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+`; charset="utf-8"`)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="part-%03d"`, i+1))
+		if part.contentType == "text/cloud-config" {
+			header.Set("Merge-Type", cloudConfigMergeType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write([]byte(part.content)); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n%s",
+		writer.Boundary(), body.String()), nil
+}
+
+// userDataTag returns the system tag that hands the user data to the VM.
+func (d *Driver) userDataTag() (string, error) {
+	userData, err := d.buildUserData()
+	if err != nil {
+		return "", err
+	}
+	return userDataTagPrefix + base64.StdEncoding.EncodeToString([]byte(userData)), nil
+}
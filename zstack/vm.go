@@ -1,22 +1,30 @@
 package zstack
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/state"
 
 	"io/ioutil"
-	"strings"
 
-	"github.com/cnrancher/go-zstack/common"
-	"github.com/cnrancher/go-zstack/infrastructure"
-	"github.com/cnrancher/go-zstack/instance"
-	"github.com/cnrancher/go-zstack/network/l3"
-	"github.com/cnrancher/go-zstack/volume"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/infrastructure"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance/affinitygroup"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/eip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/l3"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/portforwarding"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/securitygroup"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/vip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/pkg/errors"
 )
@@ -26,6 +34,30 @@ const (
 	dockerPort  = 2376
 	sshUser     = "docker"
 	sshPassword = "tcuser"
+
+	//default timeouts in seconds of the async zstack jobs
+	defaultCreateTimeout = 600
+	defaultStartTimeout  = 300
+	defaultStopTimeout   = 300
+	defaultDeleteTimeout = 300
+
+	defaultHTTPTimeout = 60
+
+	sshKeyTagPrefix = "sshkey::"
+)
+
+var (
+	// configureInstance prepares a new VM over SSH, tests replace it to
+	// skip SSH.
+	configureInstance = (*Driver).configInstance
+
+	// newSSHClient connects to the VM, tests replace it with a fake.
+	newSSHClient = ssh.NewClient
+
+	// how long configInstance waits for the key injected by cloud-init
+	// before it falls back to the password login
+	keyLoginAttempts = 24
+	keyLoginInterval = 5 * time.Second
 )
 
 //func NewDriver(hostName, storePath string) *Driver {
@@ -47,6 +79,19 @@ type Driver struct {
 	Password       string
 	ZstackEndpoint string
 
+	AccessKeyID     string
+	AccessKeySecret string
+
+	LoginType string
+	UserName  string
+	Project   string
+
+	CACert      string
+	ClientCert  string
+	ClientKey   string
+	Insecure    bool
+	HTTPTimeout int
+
 	Name        string
 	Description string
 
@@ -56,21 +101,83 @@ type Driver struct {
 
 	ImageName        string
 	InstanceOffering string
+	CPU              int
+	Memory           string
 
 	PublicKey []byte
 
 	L3NetworkNames string
+	StaticIPs      string
+	DefaultNetwork string
+	AddressNetwork string
+	EIPNetwork     string
+
+	SecurityGroups      string
+	CreateSecurityGroup bool
+	SecurityGroupRules  string
+	SecurityGroupCIDR   string
+
+	PortForwardingVIP   string
+	PortForwardingRange string
+
+	AffinityGroup       string
+	AffinityGroupPolicy string
+
+	UserTags string
 
 	SystemDiskOffering string
+	RootDiskSize       string
 
-	DataDiskOffering string
+	DataDiskOffering       string
+	DataDiskSize           string
+	DataDiskPrimaryStorage string
+	DiskLayout             string
 
 	PhysicalHost string
 
 	SSHPassword string
 
+	UserData string
+
 	InstanceUUID string
 
+	CreateTimeout int
+	StartTimeout  int
+	StopTimeout   int
+	DeleteTimeout int
+
+	ZoneUUID                   string
+	ClusterUUID                string
+	PhysicalHostUUID           string
+	PrimaryStorageUUID         string
+	ImageUUID                  string
+	InstanceOfferingUUID       string
+	SystemDiskOfferingUUID     string
+	DataDiskOfferingUUIDs      []string
+	DataDiskSizeOfferingUUIDs  []string
+	DataVolumeSizes            []int64
+	DataDiskPrimaryStorageUUID string
+	L3NetworkUUIDs             []string
+	StaticIPsByL3Network       map[string]string
+	DefaultL3NetworkUUID       string
+	AddressL3NetworkUUID       string
+	EIPNetworkUUID             string
+	SecurityGroupUUIDs         []string
+	PortForwardingVIPUUID      string
+
+	VIPUUID    string
+	EIPUUID    string
+	EIPAddress string
+
+	SecurityGroupUUID string
+	AffinityGroupUUID string
+
+	PortForwardingRuleUUIDs []string
+	DataVolumeUUIDs         []string
+	PortForwardingAddress   string
+	SSHForwardPort          int
+	DockerForwardPort       int
+
 	instanceClient         *instance.Client
 	hostClient             *infrastructure.Host
 	imageClient            *instance.Image
@@ -79,6 +186,18 @@ type Driver struct {
 	instanceOfferingClient *instance.Offering
 	l3NetworkClient        *l3.Client
 	volumeOfferingClient   *volume.Offering
+	volumeClient           *volume.Client
+	primaryStorageClient   *infrastructure.PrimaryStorage
+	vipClient              *vip.Client
+	eipClient              *eip.Client
+	securityGroupClient    *securitygroup.Client
+	portForwardingClient   *portforwarding.Client
+	affinityGroupClient    *affinitygroup.Client
+	tagClient              *tag.Client
+
+	diskLayout           []*diskMount
+	rootVolumeResized    bool
+	affinityGroupCreated bool
 }
 
 func (d *Driver) cleanup() error {
@@ -90,6 +209,14 @@ func (d *Driver) cleanup() error {
 		d.instanceOfferingClient = nil
 		d.l3NetworkClient = nil
 		d.volumeOfferingClient = nil
+		d.volumeClient = nil
+		d.primaryStorageClient = nil
+		d.vipClient = nil
+		d.eipClient = nil
+		d.securityGroupClient = nil
+		d.portForwardingClient = nil
+		d.affinityGroupClient = nil
+		d.tagClient = nil
 		d.instanceClient = nil
 	}()
 	return d.instanceClient.Cleanup()
@@ -99,8 +226,9 @@ func (d *Driver) initClients() error {
 	if d.instanceClient != nil {
 		return nil
 	}
-	commonClient := common.Client{}
-	if err := commonClient.Init(d.AccountName, d.Password, d.ZstackEndpoint); err != nil {
+	//all the resource clients share one session
+	commonClient := &common.Client{}
+	if err := commonClient.InitWithOptions(d.AccountName, d.Password, d.ZstackEndpoint, d.clientOptions()); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -128,13 +256,81 @@ func (d *Driver) initClients() error {
 	d.volumeOfferingClient = &volume.Offering{
 		Client: commonClient,
 	}
+	d.volumeClient = &volume.Client{
+		Client: commonClient,
+	}
+	d.primaryStorageClient = &infrastructure.PrimaryStorage{
+		Client: commonClient,
+	}
+	d.vipClient = &vip.Client{
+		Client: commonClient,
+	}
+	d.eipClient = &eip.Client{
+		Client: commonClient,
+	}
+	d.securityGroupClient = &securitygroup.Client{
+		Client: commonClient,
+	}
+	d.portForwardingClient = &portforwarding.Client{
+		Client: commonClient,
+	}
+	d.affinityGroupClient = &affinitygroup.Client{
+		Client: commonClient,
+	}
+	d.tagClient = &tag.Client{
+		Client: commonClient,
+	}
+	return nil
+}
+
+func (d *Driver) clientOptions() common.Options {
+	return common.Options{
+		CACert:     d.CACert,
+		ClientCert: d.ClientCert,
+		ClientKey:  d.ClientKey,
+		Insecure:   d.Insecure,
+		Timeout:    time.Duration(d.HTTPTimeout) * time.Second,
+
+		AccessKeyID:     d.AccessKeyID,
+		AccessKeySecret: d.AccessKeySecret,
+
+		LoginType: common.LoginType(d.LoginType),
+		UserName:  d.UserName,
+		Project:   d.Project,
+	}
+}
+
+// waitForJob waits at most timeout seconds for an async zstack job, or
+// fallback seconds when no timeout is configured. The zstack job keeps
+// running when the wait gives up.
+func waitForJob(async *common.AsyncResponse, response interface{}, timeout, fallback int) error {
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	return async.QueryRealResponseWithContext(ctx, response)
+}
+
+// finishJob waits for a job whose result is not needed.
+func finishJob(async *common.AsyncResponse, timeout, fallback int) error {
+	response := struct {
+		Error *common.Error `json:"error,omitempty"`
+	}{}
+	if err := waitForJob(async, &response, timeout, fallback); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error.WrapError()
+	}
 	return nil
 }
 
 func (d *Driver) getInstanceClient() *instance.Client {
 	if d.instanceClient == nil {
-		client := instance.NewInstanceClient(d.AccountName, d.Password, d.ZstackEndpoint)
-		d.instanceClient = client
+		if err := d.initClients(); err != nil {
+			log.Errorf("Get instance client error, reason: %s", err.Error())
+		}
 	}
 
 	return d.instanceClient
@@ -147,47 +343,99 @@ func (d *Driver) Create() error {
 		err error
 	)
 
+	if err := d.initClients(); err != nil {
+		return err
+	}
+	if err := d.resolveResources(); err != nil {
+		return err
+	}
+	if err := d.checkResources(); err != nil {
+		return err
+	}
+
 	if err := d.createKeyPair(); err != nil {
 		return errors.Wrap(err, "Failed to create key pair.")
 	}
+	if d.SSHUser == "" {
+		d.SSHUser = sshUser
+	}
+	userDataTag, err := d.userDataTag()
+	if err != nil {
+		return err
+	}
+	if err := d.createInstanceOffering(); err != nil {
+		return err
+	}
+	affinityGroupTag, err := d.joinAffinityGroup()
+	if err != nil {
+		return err
+	}
 	request := instance.CreateRequest{}
 	request.Params.Name = d.MachineName
-	//Following is for testing
-	request.Params.ZoneUUID = d.ZoneName
-	request.Params.ClusterUUID = d.ClusterName
-	request.Params.ImageUUID = d.ImageName
-	request.Params.L3NetworkUuids = d.getNetworks()
-	request.Params.InstanceOfferingUUID = d.InstanceOffering
-	request.Params.RootDiskOfferingUUID = d.SystemDiskOffering
-	request.Params.DataDiskOfferingUUIDs = d.getDataDisks()
-	request.Params.PrimaryStorageUUIDForRootVolume = d.PrimaryStorage
-	request.Params.HostUUID = d.PhysicalHost
-	async, err := d.instanceClient.CreateInstance(request)
-	if err != nil {
-		return errors.Wrap(err, "Get error when create vm instance in zstack.")
+	request.Params.Description = d.Description
+	request.Params.ZoneUUID = d.ZoneUUID
+	request.Params.ClusterUUID = d.ClusterUUID
+	request.Params.ImageUUID = d.ImageUUID
+	request.Params.L3NetworkUUIDs = d.L3NetworkUUIDs
+	request.Params.DefaultL3NetworkUUID = d.DefaultL3NetworkUUID
+	request.Params.InstanceOfferingUUID = d.InstanceOfferingUUID
+	request.Params.RootDiskOfferingUUID = d.SystemDiskOfferingUUID
+	request.Params.DataDiskOfferingUUIDs = append(append([]string(nil), d.DataDiskOfferingUUIDs...), d.DataDiskSizeOfferingUUIDs...)
+	request.Params.PrimaryStorageUUIDForRootVolume = d.PrimaryStorageUUID
+	request.Params.HostUUID = d.PhysicalHostUUID
+	request.SystemTags = append(request.SystemTags,
+		sshKeyTagPrefix+strings.TrimSpace(string(d.PublicKey)),
+		userDataTag)
+	request.SystemTags = append(request.SystemTags, d.staticIPTags()...)
+	if d.DataDiskPrimaryStorageUUID != "" {
+		request.SystemTags = append(request.SystemTags, fmt.Sprintf(primaryStorageForDataVolumeTag, d.DataDiskPrimaryStorageUUID))
 	}
-	response := instance.Response{}
-	if err = async.QueryRealResponse(&response, 60*time.Second); err != nil {
-		return errors.Wrap(err, "Get error when create vm instance in zstack.")
+	if affinityGroupTag != "" {
+		request.SystemTags = append(request.SystemTags, affinityGroupTag)
 	}
-	if response.Error != nil {
-		return errors.Wrap(response.Error.WrapError(), "Get error when create vm instance in zstack.")
+	request.UserTags = d.ownerTags()
+	if err := d.createInstance(request); err != nil {
+		d.dropAffinityGroup()
+		return err
 	}
-	d.InstanceUUID = response.Inventory.UUID
 
 	inventory, err := d.instanceClient.QueryInstance(d.InstanceUUID)
 	if err != nil {
 		return err
 	}
-	d.IPAddress = d.getIP(inventory)
-	if d.SSHUser == "" {
-		d.SSHUser = sshUser
+	if err = d.addToAffinityGroup(inventory); err != nil {
+		return err
+	}
+	if err = d.resizeRootVolume(inventory); err != nil {
+		return err
+	}
+	if err = d.createDataVolumes(inventory); err != nil {
+		return err
+	}
+	if len(d.DataVolumeSizes) > 0 {
+		//query again for the device IDs of the attached volumes
+		if inventory, err = d.instanceClient.QueryInstance(d.InstanceUUID); err != nil {
+			return err
+		}
+	}
+	if d.diskLayout, err = d.diskMounts(inventory); err != nil {
+		return err
 	}
+	if err = d.applySecurityGroups(inventory); err != nil {
+		return err
+	}
+	if err = d.createEIP(inventory); err != nil {
+		return err
+	}
+	if err = d.createPortForwarding(inventory); err != nil {
+		return err
+	}
+	d.IPAddress = d.getIP(inventory)
 	if d.SSHPassword == "" {
 		d.SSHPassword = sshPassword
 	}
 	ssh.SetDefaultClient(ssh.Native)
-	err = d.configInstance()
+	err = configureInstance(d)
 	if err != nil {
 		return err
 	}
@@ -195,35 +443,25 @@ func (d *Driver) Create() error {
 	return nil
 }
 
-func (d *Driver) getNetworks() []string {
-	var networkList []string
-
-	for _, t := range strings.Split(d.L3NetworkNames, ",") {
-		t = strings.TrimSpace(t)
-		if t != "" {
-			networkList = append(networkList, t)
-		}
+func (d *Driver) createInstance(request instance.CreateRequest) error {
+	async, err := d.instanceClient.CreateInstance(request)
+	if err != nil {
+		return errors.Wrap(err, "Get error when create vm instance in zstack.")
 	}
-
-	return networkList
-}
-
-func (d *Driver) getDataDisks() []string {
-	var dataDiskList []string
-
-	for _, t := range strings.Split(d.DataDiskOffering, ",") {
-		t = strings.TrimSpace(t)
-		if t != "" {
-			dataDiskList = append(dataDiskList, t)
-		}
+	response := instance.Response{}
+	if err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout); err != nil {
+		return errors.Wrap(err, "Get error when create vm instance in zstack.")
 	}
-
-	return dataDiskList
+	if response.Error != nil {
+		return errors.Wrap(response.Error.WrapError(), "Get error when create vm instance in zstack.")
+	}
+	d.InstanceUUID = response.Inventory.UUID
+	return nil
 }
 
 func (d *Driver) createKeyPair() error {
 
-	log.Debug("SSH key path: %s", d.GetSSHKeyPath())
+	log.Debugf("SSH key path: %s", d.GetSSHKeyPath())
 	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
 		return err
 	}
@@ -249,19 +487,6 @@ func (d *Driver) uploadKeyPair(sshClient ssh.Client) error {
 	return err
 }
 
-// Mount the addtional disk
-func (d *Driver) autoFdisk(sshClient ssh.Client) {
-	script := fmt.Sprintf("cat > ~/machine_autofdisk.sh <<MACHINE_EOF\n%s\nMACHINE_EOF\n", instance.AutoFdiskScript)
-	output, err := sshClient.Output(script)
-	if d.SSHUser == "root" {
-		output, err = sshClient.Output("sh ~/machine_autofdisk.sh")
-	} else {
-		output, err = sshClient.Output("sudo su root ~/machine_autofdisk.sh")
-	}
-
-	log.Infof("%s | Auto Fdisk command err, output: %v: %s", d.MachineName, err, output)
-}
-
 func (d *Driver) configInstance() error {
 	ipAddr := d.IPAddress
 	port, _ := d.GetSSHPort()
@@ -269,26 +494,46 @@ func (d *Driver) configInstance() error {
 
 	log.Infof("Waiting SSH service %s is ready to connect ...", tcpAddr)
 
-	log.Infof("Uploading SSH keypair to %s ...", tcpAddr)
-
-	auth := ssh.Auth{
-		Passwords: []string{d.SSHPassword},
+	sshClient, err := newSSHClient(d.GetSSHUsername(), ipAddr, port, &ssh.Auth{
+		Keys: []string{d.GetSSHKeyPath()},
+	})
+	if err != nil {
+		return err
 	}
 
-	sshClient, err := ssh.NewClient(d.GetSSHUsername(), ipAddr, port, &auth)
+	if err := d.waitForKeyLogin(sshClient); err != nil {
+		// The image has no cloud-init to install the key from the sshkey
+		// tag, so upload it with the password login instead.
+		log.Infof("The SSH key is not accepted by %s, uploading it with the password login ...", tcpAddr)
 
-	if err != nil {
-		return err
+		auth := ssh.Auth{
+			Passwords: []string{d.SSHPassword},
+		}
+		sshClient, err = newSSHClient(d.GetSSHUsername(), ipAddr, port, &auth)
+		if err != nil {
+			return err
+		}
+
+		err = d.uploadKeyPair(sshClient)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = d.uploadKeyPair(sshClient)
-	if err != nil {
+	if err := d.growRootFilesystem(sshClient); err != nil {
 		return err
 	}
+	return d.applyDiskLayout(sshClient)
+}
 
-	d.autoFdisk(sshClient)
-
-	return nil
+func (d *Driver) waitForKeyLogin(sshClient ssh.Client) error {
+	return mcnutils.WaitForSpecific(func() bool {
+		_, err := sshClient.Output("exit 0")
+		if err != nil {
+			log.Debugf("SSH key login to %s is not ready: %v", d.IPAddress, err)
+		}
+		return err == nil
+	}, keyLoginAttempts, keyLoginInterval)
 }
 
 // DriverName returns the name of the driver
@@ -301,24 +546,83 @@ func (d *Driver) DriverName() string {
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 	//ToDo fulfill the usage for each flag
 	return []mcnflag.Flag{
+		mcnflag.StringFlag{
+			Name:   "zstack-login-type",
+			Usage:  "How to login zstack: account, user, ldap or iam2",
+			EnvVar: "ZSTACK_LOGIN_TYPE",
+			Value:  string(common.LoginTypeAccount),
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-account-name",
-			Usage:  "The login zstack account",
+			Usage:  "The login zstack account, or the account of the user with the user login",
 			EnvVar: "ZSTACK_ACCOUNT_NAME",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-user-name",
+			Usage:  "The user name, LDAP uid or IAM2 virtual ID with the user, ldap or iam2 login",
+			EnvVar: "ZSTACK_USER_NAME",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-account-password",
 			Usage:  "The login zstack password",
 			EnvVar: "ZSTACK_ACCOUNT_PASSWORD",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-project",
+			Usage:  "Optional. The IAM2 project name or UUID to login to with the iam2 login",
+			EnvVar: "ZSTACK_PROJECT",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-access-key-id",
+			Usage:  "The AccessKey ID to sign zstack requests with, instead of the account and password",
+			EnvVar: "ZSTACK_ACCESS_KEY_ID",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-access-key-secret",
+			Usage:  "The AccessKey secret to sign zstack requests with",
+			EnvVar: "ZSTACK_ACCESS_KEY_SECRET",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-endpoint",
 			Usage:  "The endpoint of zstack server",
 			EnvVar: "ZSTACK_ENDPOINT",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-ca-cert",
+			Usage:  "Optional. CA bundle file or PEM content trusted for the zstack endpoint",
+			EnvVar: "ZSTACK_CA_CERT",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-client-cert",
+			Usage:  "Optional. Client certificate file or PEM content for the zstack endpoint",
+			EnvVar: "ZSTACK_CLIENT_CERT",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-client-key",
+			Usage:  "Optional. Client key file or PEM content for the zstack endpoint",
+			EnvVar: "ZSTACK_CLIENT_KEY",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "zstack-insecure",
+			Usage:  "Optional. Skip the verification of the zstack endpoint certificate",
+			EnvVar: "ZSTACK_INSECURE",
+		},
+		mcnflag.IntFlag{
+			Name:   "zstack-http-timeout",
+			Usage:  "Optional. Seconds to wait for each request to the zstack endpoint",
+			EnvVar: "ZSTACK_HTTP_TIMEOUT",
+			Value:  defaultHTTPTimeout,
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-description",
 			Usage:  "Optional. The detailed description of vm",
@@ -327,13 +631,13 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   "zstack-zone-name",
-			Usage:  "Optional. Specify the zone name vm belongs to",
+			Usage:  "Optional. Specify the zone name or UUID vm belongs to",
 			EnvVar: "ZSTACK_ZONE_NAME",
 			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "zstack-cluster-name",
-			Usage:  "Optional. Specify the cluster name vm belongs to",
+			Usage:  "Optional. Specify the cluster name or UUID vm belongs to",
 			EnvVar: "ZSTACK_CLUSTER_NAME",
 			Value:  "",
 		},
@@ -345,46 +649,183 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   "zstack-image-name",
-			Usage:  "The image to create the vm",
+			Usage:  "The image name or UUID to create the vm",
 			EnvVar: "ZSTACK_IMAGE_NAME",
 			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "zstack-instance-offering",
-			Usage:  "Instance offering defined in zstack.",
+			Usage:  "Instance offering name or UUID defined in zstack, or use --zstack-cpu and --zstack-memory.",
 			EnvVar: "ZSTACK_INSTANCE_OFFERING",
 			Value:  "",
 		},
+		mcnflag.IntFlag{
+			Name:   "zstack-cpu",
+			Usage:  "CPU count of the vm, an instance offering with the same CPU and memory is reused or created.",
+			EnvVar: "ZSTACK_CPU",
+			Value:  0,
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-memory",
+			Usage:  "Memory size of the vm, e.g. 4G or 512M, a bare number is in MiB, used with --zstack-cpu.",
+			EnvVar: "ZSTACK_MEMORY",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-network-name",
-			Usage:  "L3 network name in zone.",
+			Usage:  "Comma separated L3 network names or UUIDs in zone.",
 			EnvVar: "ZSTACK_NETWORK_NAME",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-default-network",
+			Usage:  "Optional. The network name or UUID of the default route, the first network by default.",
+			EnvVar: "ZSTACK_DEFAULT_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-address-network",
+			Usage:  "Optional. The network name or UUID whose address is used to reach the machine, the default network by default.",
+			EnvVar: "ZSTACK_ADDRESS_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-eip-network",
+			Usage:  "Optional. The public network name or UUID to allocate an EIP on for the machine.",
+			EnvVar: "ZSTACK_EIP_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-security-group",
+			Usage:  "Optional. Comma separated existing security group names or UUIDs to add the machine to, they must be attached to the address network.",
+			EnvVar: "ZSTACK_SECURITY_GROUP",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "zstack-create-security-group",
+			Usage:  "Optional. Create a security group for the machine which opens SSH, Docker and the extra ports.",
+			EnvVar: "ZSTACK_CREATE_SECURITY_GROUP",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-security-group-rule",
+			Usage:  "Optional. Comma separated extra ports to open as [tcp|udp:]port[-port][@cidr], e.g. 80,udp:8000-8100@10.0.0.0/8.",
+			EnvVar: "ZSTACK_SECURITY_GROUP_RULE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-security-group-cidr",
+			Usage:  "Optional. The source CIDR allowed by the rules of the created security group.",
+			EnvVar: "ZSTACK_SECURITY_GROUP_CIDR",
+			Value:  defaultSecurityGroupCIDR,
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-tag",
+			Usage:  "Optional. Comma separated key=value user tags for the vm and the resources created for it.",
+			EnvVar: "ZSTACK_TAG",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-affinity-group",
+			Usage:  "Optional. Name of the affinity group to place the vm in, it is created when it does not exist.",
+			EnvVar: "ZSTACK_AFFINITY_GROUP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-affinity-group-policy",
+			Usage:  "Optional. Policy of the affinity group, antiSoft or antiHard.",
+			EnvVar: "ZSTACK_AFFINITY_GROUP_POLICY",
+			Value:  defaultAffinityGroupPolicy,
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-port-forwarding-vip",
+			Usage:  "Optional. A shared VIP name or UUID to reach the machine through port forwarding rules instead of an EIP.",
+			EnvVar: "ZSTACK_PORT_FORWARDING_VIP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-port-forwarding-range",
+			Usage:  "Optional. The start-end range of the VIP ports to forward from.",
+			EnvVar: "ZSTACK_PORT_FORWARDING_RANGE",
+			Value:  defaultPortForwardingRange,
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-static-ip",
+			Usage:  "Optional. Comma separated network=ip static IPs, a bare IP is for the first network.",
+			EnvVar: "ZSTACK_STATIC_IP",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-system-disk-offering",
-			Usage:  "Optional. Specify the root disk offering.",
+			Usage:  "Optional. Specify the root disk offering name or UUID, required with ISO images.",
 			EnvVar: "ZSTACK_SYSTEM_DISK_OFFERING",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-root-disk-size",
+			Usage:  "Optional. Expand the root volume of a non-ISO image to this size, e.g. 100G.",
+			EnvVar: "ZSTACK_ROOT_DISK_SIZE",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-data-disk-offering",
-			Usage:  "Optional. Specify the data disk offering.",
+			Usage:  "Optional. Comma separated data disk offering names or UUIDs.",
 			EnvVar: "ZSTACK_DATA_DISK_OFFERING",
 			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "zstack-primary-storage",
-			Usage:  "Optional. Specify the root volume.",
+			Usage:  "Optional. Specify the primary storage name or UUID for the root volume.",
 			EnvVar: "ZSTACK_PRIMARY_STORAGE",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-data-disk-size",
+			Usage:  "Optional. Comma separated data disk sizes, e.g. 100G,50G, served by a disk offering of that size or a new data volume.",
+			EnvVar: "ZSTACK_DATA_DISK_SIZE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-data-disk-primary-storage",
+			Usage:  "Optional. The primary storage name or UUID for the data disks, the root volume's by default.",
+			EnvVar: "ZSTACK_DATA_DISK_PRIMARY_STORAGE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "zstack-disk-layout",
+			Usage:  "Optional. How to mount the data volumes, inline or as a file path: deviceId=mountpoint[:ext4|xfs] entries, e.g. 1=/var/lib/docker,2=/var/lib/longhorn:xfs. The first data volume holds /var/lib/docker by default.",
+			EnvVar: "ZSTACK_DISK_LAYOUT",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-physical-host",
-			Usage:  "Optional. Specify the root volume.",
+			Usage:  "Optional. Specify the physical host name or UUID to run the vm on.",
 			EnvVar: "ZSTACK_PHYSICAL_HOST",
 			Value:  "",
 		},
+		mcnflag.IntFlag{
+			Name:   "zstack-create-timeout",
+			Usage:  "Optional. Seconds to wait for the vm to be created.",
+			EnvVar: "ZSTACK_CREATE_TIMEOUT",
+			Value:  defaultCreateTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "zstack-start-timeout",
+			Usage:  "Optional. Seconds to wait for the vm to start or reboot.",
+			EnvVar: "ZSTACK_START_TIMEOUT",
+			Value:  defaultStartTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "zstack-stop-timeout",
+			Usage:  "Optional. Seconds to wait for the vm to stop.",
+			EnvVar: "ZSTACK_STOP_TIMEOUT",
+			Value:  defaultStopTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "zstack-delete-timeout",
+			Usage:  "Optional. Seconds to wait for the vm to be deleted and expunged.",
+			EnvVar: "ZSTACK_DELETE_TIMEOUT",
+			Value:  defaultDeleteTimeout,
+		},
 		mcnflag.StringFlag{
 			Name:   "zstack-ssh-user",
 			Usage:  "Optional. Specify the ssh password for root user.",
@@ -397,6 +838,12 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ZSTACK_SSH_PASSWORD",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "zstack-userdata",
+			Usage:  "Optional. A cloud-config or shell script, inline or as a file path, to run on the first boot",
+			EnvVar: "ZSTACK_USERDATA",
+			Value:  "",
+		},
 	}
 }
 
@@ -410,6 +857,15 @@ func (d *Driver) GetIP() (string, error) {
 	return d.getIP(inventory), nil
 }
 
+// GetSSHPort returns the forwarded SSH port of the shared VIP when the
+// machine is reached through port forwarding.
+func (d *Driver) GetSSHPort() (int, error) {
+	if d.SSHForwardPort != 0 {
+		return d.SSHForwardPort, nil
+	}
+	return d.BaseDriver.GetSSHPort()
+}
+
 // GetSSHHostname returns hostname for use with ssh
 func (d *Driver) GetSSHHostname() (string, error) {
 	return d.GetIP()
@@ -425,53 +881,71 @@ func (d *Driver) GetURL() (string, error) {
 	if ip == "" {
 		return "", nil
 	}
-	return fmt.Sprintf("tcp://%s:%d", ip, dockerPort), nil
+	port := dockerPort
+	if d.DockerForwardPort != 0 {
+		port = d.DockerForwardPort
+	}
+	return fmt.Sprintf("tcp://%s:%d", ip, port), nil
 }
 
 // GetState returns the state that the host is in (running, stopped, etc)
 func (d *Driver) GetState() (state.State, error) {
 	i, err := d.getInstanceClient().QueryInstance(d.InstanceUUID)
 	if err != nil {
-		return 0, errors.Wrap(err, "Get error when get instance info from zstack.")
-	}
-	var rtnState state.State
-	switch i.State {
-	// "",
-	case "":
-		rtnState = state.None
-		// "Running",
-	case "Running":
-		rtnState = state.Running
-		// "Paused",
-	case "Paused":
-		rtnState = state.Paused
-		// "Saved",
-		// "Stopped",
-	case "Stopped":
-		rtnState = state.Stopped
-		// "Stopping",
-		// "Starting",
-		// "Error",
-		// "Timeout",
-	}
-	return rtnState, nil
+		if errors.Cause(err) == instance.ErrInstanceNotFound {
+			return state.Error, errors.Errorf("the instance %s no longer exists in zstack", d.InstanceUUID)
+		}
+		return state.None, errors.Wrap(err, "Get error when get instance info from zstack.")
+	}
+	if i.State == instance.VMInstanceStateDestroyed {
+		return state.Error, errors.Errorf("the instance %s has been destroyed in zstack", d.InstanceUUID)
+	}
+	return machineState(i.State), nil
+}
+
+// machineState maps a ZStack VM state to the closest libmachine state.
+func machineState(s instance.VMInstanceState) state.State {
+	switch s {
+	case instance.VMInstanceStateRunning,
+		instance.VMInstanceStateMigrating,
+		instance.VMInstanceStateVolumeMigrating:
+		return state.Running
+	case instance.VMInstanceStateCreated,
+		instance.VMInstanceStateStarting,
+		instance.VMInstanceStateRebooting,
+		instance.VMInstanceStateResuming:
+		return state.Starting
+	case instance.VMInstanceStatePausing,
+		instance.VMInstanceStatePaused:
+		return state.Paused
+	case instance.VMInstanceStateStopping,
+		instance.VMInstanceStateDestroying,
+		instance.VMInstanceStateExpunging:
+		return state.Stopping
+	case instance.VMInstanceStateStopped:
+		return state.Stopped
+	case instance.VMInstanceStateUnknown,
+		instance.VMInstanceStateCrashed,
+		instance.VMInstanceStateError:
+		return state.Error
+	}
+	return state.None
 }
 
 // Kill stops a host forcefully
 func (d *Driver) Kill() error {
-	async, err := d.instanceClient.StopInstance(d.InstanceUUID, instance.StopInstanceTypeCold)
+	async, err := d.getInstanceClient().StopInstance(d.InstanceUUID, instance.StopInstanceTypeCold)
 	if err != nil {
 		return errors.Wrap(err, "Get error when sending kill instance request.")
 	}
 	responseStruct := instance.Response{}
-	if err = async.QueryRealResponse(&responseStruct, 60*time.Second); err != nil {
+	if err = waitForJob(async, &responseStruct, d.StopTimeout, defaultStopTimeout); err != nil {
 		return errors.Wrap(err, "Get error when query response for zstack kill instance job.")
 	}
 	if responseStruct.Error != nil {
 		return errors.Wrap(responseStruct.Error.WrapError(), "Get error when kill zstack instance.")
 	}
-	//ToDo change it to new type
-	if responseStruct.Inventory.State != "Stopped" {
+	if responseStruct.Inventory.State != instance.VMInstanceStateStopped {
 		return errors.New("the target Instance state is not as expect,'Stopped'")
 	}
 	return nil
@@ -485,55 +959,145 @@ func (d *Driver) PreCreateCheck() error {
 		return err
 	}
 
-	return nil
+	//resolve names to UUIDs up front so a typo fails before anything is created
+	if err := d.resolveResources(); err != nil {
+		return err
+	}
+	return d.checkResources()
 }
 
-// Remove a host
-func (d *Driver) Remove() error {
-	//First delete it
-	async, err := d.getInstanceClient().DeleteInstance(d.InstanceUUID)
-	if err != nil {
-		return errors.Wrap(err, "Get error when sending delete instance request.")
+// checkResources validates the resolved resources against each other.
+func (d *Driver) checkResources() error {
+	if err := d.checkImage(); err != nil {
+		return err
 	}
-	responseStruct := instance.Response{}
-	if err = async.QueryRealResponse(&responseStruct, 60*time.Second); err != nil {
-		return errors.Wrap(err, "Get error when query response for zstack delete instance job.")
+	if err := d.checkSecurityGroups(); err != nil {
+		return err
 	}
-	if responseStruct.Error != nil {
-		return errors.Wrap(responseStruct.Error.WrapError(), "Get error when delete zstack instance.")
+	return d.checkStaticIPs()
+}
+
+// Remove a host. Resources which are already gone count as removed, and a
+// failure does not stop the removal of the others, so removing a half
+// deleted machine again finishes the job.
+func (d *Driver) Remove() error {
+	if err := d.initClients(); err != nil {
+		return err
 	}
+	summary := &removeSummary{}
+	d.removeEIP(summary)
+	d.removePortForwarding(summary)
+	d.removeSecurityGroup(summary)
+	d.removeFromAffinityGroup(summary)
+
+	//The data volumes are only detached from the destroyed instance
+	if d.removeInstance(summary) {
+		d.removeDataVolumes(summary)
+	} else {
+		for _, uuid := range d.DataVolumeUUIDs {
+			summary.fail("data volume", uuid, errors.New("kept attached to the vm instance which was not removed"))
+		}
+	}
+	return summary.report(d.MachineName)
+}
 
-	//Then expunge the instance
-	async, err = d.getInstanceClient().ExpungeInstance(d.InstanceUUID)
+// Restart a host. This may just call Stop(); Start() if the provider does not
+// have any special restart behaviour.
+func (d *Driver) Restart() error {
+	async, err := d.getInstanceClient().RestartInstance(d.InstanceUUID)
 	if err != nil {
-		return errors.Wrap(err, "Get error when sending expunge instance request.")
+		return errors.Wrap(err, "Get error when sending reboot instance request.")
 	}
-	responseStruct = instance.Response{}
-	if err = async.QueryRealResponse(&responseStruct, 60*time.Second); err != nil {
-		return errors.Wrap(err, "Get error when query response for zstack expunge instance job.")
+	responseStruct := instance.Response{}
+	err = waitForJob(async, &responseStruct, d.StartTimeout, defaultStartTimeout)
+	if err == nil && responseStruct.Error != nil {
+		err = responseStruct.Error.WrapError()
 	}
-	if responseStruct.Error != nil {
-		return errors.Wrap(responseStruct.Error.WrapError(), "Get error when expunge zstack instance.")
+	if err != nil {
+		// a reboot which finished after the job gave up must not be
+		// followed by a stop
+		if i, queryErr := d.getInstanceClient().QueryInstance(d.InstanceUUID); queryErr == nil && i.State == instance.VMInstanceStateRunning {
+			log.Warnf("%s | Reboot did not report completion but the instance is running: %v", d.MachineName, err)
+			return d.waitForRunning()
+		}
+		log.Warnf("%s | Reboot did not complete, falling back to stop and start: %v", d.MachineName, err)
+		return d.restartByStopStart()
 	}
+	return d.waitForRunning()
+}
 
-	return nil
+// restartByStopStart restarts the instance the hard way when a reboot does
+// not complete, powering it off if it does not stop gracefully either.
+func (d *Driver) restartByStopStart() error {
+	if err := d.Stop(); err != nil {
+		log.Warnf("%s | Graceful stop failed, stopping instance forcefully: %v", d.MachineName, err)
+		if err := d.Kill(); err != nil {
+			return err
+		}
+	}
+	if err := d.Start(); err != nil {
+		return err
+	}
+	return d.waitForRunning()
 }
 
-// Restart a host. This may just call Stop(); Start() if the provider does not
-// have any special restart behaviour.
-func (d *Driver) Restart() error {
+// waitForRunning waits until the instance is Running with an IP address and
+// refreshes the stored IP, which may change across a restart.
+func (d *Driver) waitForRunning() error {
+	timeout := d.StartTimeout
+	if timeout <= 0 {
+		timeout = defaultStartTimeout
+	}
+	attempts := timeout / instance.DefaultWaitForInterval
+	if attempts < 1 {
+		attempts = 1
+	}
+	var lastState instance.VMInstanceState
+	err := mcnutils.WaitForSpecificOrError(func() (bool, error) {
+		i, err := d.getInstanceClient().QueryInstance(d.InstanceUUID)
+		if err != nil {
+			return false, errors.Wrap(err, "Get error when get instance info from zstack.")
+		}
+		lastState = i.State
+		if i.State != instance.VMInstanceStateRunning || d.getIP(i) == "" {
+			return false, nil
+		}
+		d.IPAddress = d.getIP(i)
+		return true, nil
+	}, attempts, instance.DefaultWaitForInterval*time.Second)
+	if err != nil {
+		return errors.Wrapf(err, "the instance is not running with an IP after restart, last state '%s'", lastState)
+	}
 	return nil
 }
 
 // SetConfigFromFlags configures the driver with the object that was returned
 // by RegisterCreateFlags
 func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
-	d.AccountName = opts.String("zstack-account-name")
-	d.Password = opts.String("zstack-account-password")
 	d.ZstackEndpoint = opts.String("zstack-endpoint")
-	if d.AccountName == "" || d.Password == "" || d.ZstackEndpoint == "" {
-		return errors.Errorf("AccountName, password and endpoint are required.")
+	if d.ZstackEndpoint == "" {
+		return errors.Errorf("The endpoint is required.")
+	}
+	d.AccessKeyID = opts.String("zstack-access-key-id")
+	d.AccessKeySecret = opts.String("zstack-access-key-secret")
+	if d.AccessKeyID != "" || d.AccessKeySecret != "" {
+		if d.AccessKeyID == "" || d.AccessKeySecret == "" {
+			return errors.Errorf("The AccessKey ID and secret must be set together.")
+		}
+	} else if err := d.setLoginFromFlags(opts); err != nil {
+		return err
+	}
+	d.CACert = opts.String("zstack-ca-cert")
+	d.ClientCert = opts.String("zstack-client-cert")
+	d.ClientKey = opts.String("zstack-client-key")
+	if (d.ClientCert == "") != (d.ClientKey == "") {
+		return errors.Errorf("The client certificate and key must be set together.")
 	}
+	d.Insecure = opts.Bool("zstack-insecure")
+	if d.Insecure {
+		log.Warn("The certificate of the zstack endpoint will not be verified.")
+	}
+	d.HTTPTimeout = opts.Int("zstack-http-timeout")
 	d.Description = opts.String("zstack-description")
 
 	//Following configuration is about where the host is
@@ -553,27 +1117,140 @@ func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 		return errors.Errorf("The image name is required.")
 	}
 	d.InstanceOffering = opts.String("zstack-instance-offering")
-	if d.InstanceOffering == "" {
-		return errors.Errorf("The instance offering is required.")
+	d.CPU = opts.Int("zstack-cpu")
+	d.Memory = opts.String("zstack-memory")
+	switch {
+	case d.InstanceOffering != "" && (d.CPU != 0 || d.Memory != ""):
+		return errors.Errorf("The instance offering can not be used with the CPU and memory options.")
+	case d.InstanceOffering == "" && d.CPU == 0 && d.Memory == "":
+		return errors.Errorf("The instance offering, or the CPU and memory, is required.")
+	case d.InstanceOffering == "" && (d.CPU <= 0 || d.Memory == ""):
+		return errors.Errorf("Both a positive CPU count and the memory size are required without an instance offering.")
+	}
+	if d.Memory != "" {
+		if _, err := parseMemory(d.Memory); err != nil {
+			return err
+		}
 	}
 	d.L3NetworkNames = opts.String("zstack-network-name")
 	if d.L3NetworkNames == "" {
 		return errors.Errorf("The network configuration is required.")
 	}
+	d.StaticIPs = opts.String("zstack-static-ip")
+	d.DefaultNetwork = opts.String("zstack-default-network")
+	d.AddressNetwork = opts.String("zstack-address-network")
+	d.EIPNetwork = opts.String("zstack-eip-network")
+	d.PortForwardingVIP = opts.String("zstack-port-forwarding-vip")
+	d.PortForwardingRange = opts.String("zstack-port-forwarding-range")
+	if d.EIPNetwork != "" && d.PortForwardingVIP != "" {
+		return errors.Errorf("The EIP network and the port forwarding VIP can not be set together.")
+	}
+	if _, _, err := parsePortRange(d.PortForwardingRange); err != nil {
+		return err
+	}
+
+	d.SecurityGroups = opts.String("zstack-security-group")
+	d.CreateSecurityGroup = opts.Bool("zstack-create-security-group")
+	d.SecurityGroupRules = opts.String("zstack-security-group-rule")
+	d.SecurityGroupCIDR = opts.String("zstack-security-group-cidr")
+	if d.SecurityGroupRules != "" && !d.CreateSecurityGroup {
+		return errors.Errorf("The security group rules need --zstack-create-security-group.")
+	}
+	if _, err := parseSecurityGroupRules(d.SecurityGroupRules, d.SecurityGroupCIDR); err != nil {
+		return err
+	}
+
+	d.UserTags = opts.String("zstack-tag")
+	if _, err := parseUserTags(d.UserTags); err != nil {
+		return err
+	}
+
+	d.AffinityGroup = opts.String("zstack-affinity-group")
+	d.AffinityGroupPolicy = opts.String("zstack-affinity-group-policy")
+	if d.AffinityGroupPolicy == "" {
+		d.AffinityGroupPolicy = defaultAffinityGroupPolicy
+	}
+	if !affinityGroupPolicies[d.AffinityGroupPolicy] {
+		return errors.Errorf("Invalid affinity group policy %q, expect antiSoft or antiHard.", d.AffinityGroupPolicy)
+	}
 
 	//if the image is the type of ISO, then this argument is required
 	d.SystemDiskOffering = opts.String("zstack-system-disk-offering")
-	if d.SystemDiskOffering == "" {
-		return errors.Errorf("The Root/System disk size is required.")
+	d.RootDiskSize = opts.String("zstack-root-disk-size")
+	if d.RootDiskSize != "" {
+		if _, err := parseSize(d.RootDiskSize); err != nil {
+			return err
+		}
 	}
 
 	d.PrimaryStorage = opts.String("zstack-primary-storage")
 	d.DataDiskOffering = opts.String("zstack-data-disk-offering")
+	d.DataDiskSize = opts.String("zstack-data-disk-size")
+	if _, err := parseSizes(d.DataDiskSize); err != nil {
+		return err
+	}
+	d.DataDiskPrimaryStorage = opts.String("zstack-data-disk-primary-storage")
+	diskLayout, err := readFlagContent("disk layout", opts.String("zstack-disk-layout"))
+	if err != nil {
+		return err
+	}
+	if _, err := parseDiskLayout(diskLayout); err != nil {
+		return err
+	}
+	d.DiskLayout = diskLayout
 	d.PhysicalHost = opts.String("zstack-physical-host")
 
+	d.CreateTimeout = opts.Int("zstack-create-timeout")
+	d.StartTimeout = opts.Int("zstack-start-timeout")
+	d.StopTimeout = opts.Int("zstack-stop-timeout")
+	d.DeleteTimeout = opts.Int("zstack-delete-timeout")
+
 	d.SSHPassword = opts.String("zstack-ssh-password")
 	d.SSHUser = opts.String("zstack-ssh-user")
 
+	userData, err := readFlagContent("user data", opts.String("zstack-userdata"))
+	if err != nil {
+		return err
+	}
+	if userData != "" {
+		if _, err := userDataContentType(userData); err != nil {
+			return err
+		}
+	}
+	d.UserData = userData
+
+	return nil
+}
+
+func (d *Driver) setLoginFromFlags(opts drivers.DriverOptions) error {
+	d.LoginType = opts.String("zstack-login-type")
+	d.AccountName = opts.String("zstack-account-name")
+	d.UserName = opts.String("zstack-user-name")
+	d.Password = opts.String("zstack-account-password")
+	d.Project = opts.String("zstack-project")
+	if d.Password == "" {
+		return errors.Errorf("The password, or an AccessKey, is required.")
+	}
+
+	switch common.LoginType(d.LoginType) {
+	case "", common.LoginTypeAccount:
+		if d.AccountName == "" {
+			return errors.Errorf("AccountName and password, or an AccessKey, are required.")
+		}
+	case common.LoginTypeUser:
+		if d.AccountName == "" || d.UserName == "" {
+			return errors.Errorf("The account name and user name are required with the user login.")
+		}
+	case common.LoginTypeLdap, common.LoginTypeIAM2:
+		if d.UserName == "" {
+			return errors.Errorf("The user name is required with the %s login.", d.LoginType)
+		}
+	default:
+		return errors.Errorf("Unknown login type %q, expect account, user, ldap or iam2.", d.LoginType)
+	}
+	if d.Project != "" && common.LoginType(d.LoginType) != common.LoginTypeIAM2 {
+		return errors.Errorf("The project can only be set with the iam2 login.")
+	}
 	return nil
 }
 
@@ -584,14 +1261,13 @@ func (d *Driver) Start() error {
 		return errors.Wrap(err, "Get error when sending start instance request.")
 	}
 	responseStruct := instance.Response{}
-	if err = async.QueryRealResponse(&responseStruct, 60*time.Second); err != nil {
+	if err = waitForJob(async, &responseStruct, d.StartTimeout, defaultStartTimeout); err != nil {
 		return errors.Wrap(err, "Get error when querying response for zstack start instance job.")
 	}
 	if responseStruct.Error != nil {
 		return errors.Wrap(responseStruct.Error.WrapError(), "Get error when start zstack instance.")
 	}
-	//ToDo change it to new type
-	if responseStruct.Inventory.State != "Running" {
+	if responseStruct.Inventory.State != instance.VMInstanceStateRunning {
 		return errors.New("the target Instance state is not as expect,'Running'")
 	}
 	return nil
@@ -604,22 +1280,14 @@ func (d *Driver) Stop() error {
 		return errors.Wrap(err, "Get error when sending stop instance request.")
 	}
 	responseStruct := instance.Response{}
-	if err = async.QueryRealResponse(&responseStruct, 60*time.Second); err != nil {
+	if err = waitForJob(async, &responseStruct, d.StopTimeout, defaultStopTimeout); err != nil {
 		return errors.Wrap(err, "Get error when query response for zstack stop instance job.")
 	}
 	if responseStruct.Error != nil {
 		return errors.Wrap(responseStruct.Error.WrapError(), "Get error when stop zstack instance.")
 	}
-	//ToDo change it to new type
-	if responseStruct.Inventory.State != "Stopped" {
+	if responseStruct.Inventory.State != instance.VMInstanceStateStopped {
 		return errors.New("the target Instance state is not as expect,'Stopped'")
 	}
 	return nil
 }
-
-func (d *Driver) getIP(instance *instance.VMInstanceInventory) string {
-	if len(instance.VMNics) > 0 {
-		return instance.VMNics[0].IP
-	}
-	return ""
-}
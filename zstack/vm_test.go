@@ -0,0 +1,1432 @@
+package zstack
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/zstack/zstacktest"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	testAccount  = "admin"
+	testPassword = "password"
+	testMachine  = "test-machine"
+)
+
+func init() {
+	configureInstance = func(*Driver) error { return nil }
+	common.AsyncPollInterval = 10 * time.Millisecond
+	common.AsyncMaxPollInterval = 50 * time.Millisecond
+}
+
+type testEnv struct {
+	server    *zstacktest.Server
+	storePath string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	storePath, err := ioutil.TempDir("", "zstack-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(storePath, "machines", testMachine), 0700); err != nil {
+		t.Fatal(err)
+	}
+	server := zstacktest.NewServer(testAccount, testPassword)
+	zone := server.AddNamed("zones", "zone-1")
+	server.AddNamed("images", "ubuntu")
+	server.AddNamed("instance-offerings", "small")
+	server.AddResource("l3-networks", map[string]interface{}{
+		"name":     "flat",
+		"zoneUuid": zone,
+		"ipRanges": []map[string]interface{}{{"startIp": "10.0.0.2", "endIp": "10.0.0.254"}},
+	})
+	server.AddNamed("disk-offerings", "root-disk")
+	return &testEnv{server: server, storePath: storePath}
+}
+
+func (e *testEnv) close() {
+	e.server.Close()
+	os.RemoveAll(e.storePath)
+}
+
+func (e *testEnv) driver(t *testing.T, flags map[string]interface{}) *Driver {
+	d := NewDriver(testMachine, e.storePath).(*Driver)
+	values := map[string]interface{}{
+		"zstack-account-name":         testAccount,
+		"zstack-account-password":     testPassword,
+		"zstack-endpoint":             e.server.URL,
+		"zstack-zone-name":            "zone-1",
+		"zstack-image-name":           "ubuntu",
+		"zstack-instance-offering":    "small",
+		"zstack-network-name":         "flat",
+		"zstack-system-disk-offering": "root-disk",
+	}
+	for k, v := range flags {
+		values[k] = v
+	}
+	opts := &drivers.CheckDriverOptions{
+		FlagsValues: values,
+		CreateFlags: d.GetCreateFlags(),
+	}
+	if err := d.SetConfigFromFlags(opts); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// existing returns a driver for a machine created earlier, as docker-machine
+// loads it from the store for every later command.
+func (e *testEnv) existing(t *testing.T, state instance.VMInstanceState) *Driver {
+	uuid := e.server.AddVM(&instance.VMInstanceInventory{
+		Name:  testMachine,
+		State: state,
+		VMNics: []*instance.VMNic{
+			{IP: "10.0.0.2"},
+		},
+	})
+	d := e.driver(t, nil)
+	d.InstanceUUID = uuid
+	return d
+}
+
+func TestCreate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, nil)
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := e.server.VM(d.InstanceUUID)
+	if vm == nil {
+		t.Fatalf("vm %s was not created", d.InstanceUUID)
+	}
+	if vm.ImageUUID != d.ImageUUID || d.ImageUUID == "" {
+		t.Errorf("vm image = %q, want resolved image %q", vm.ImageUUID, d.ImageUUID)
+	}
+	if vm.ZoneUUID != d.ZoneUUID || d.ZoneUUID == "" {
+		t.Errorf("vm zone = %q, want resolved zone %q", vm.ZoneUUID, d.ZoneUUID)
+	}
+	if d.IPAddress != vm.VMNics[0].IP {
+		t.Errorf("IPAddress = %q, want %q", d.IPAddress, vm.VMNics[0].IP)
+	}
+	sshKeyTag := sshKeyTagPrefix + strings.TrimSpace(string(d.PublicKey))
+	found := false
+	for _, tag := range e.server.CreateRequest(d.InstanceUUID).SystemTags {
+		found = found || tag == sshKeyTag
+	}
+	if !found {
+		t.Errorf("the vm is not created with the %q tag", sshKeyTag)
+	}
+
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != state.Running {
+		t.Errorf("state = %s, want %s", s, state.Running)
+	}
+}
+
+func TestCreateUserData(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	script := "#!/bin/sh\necho hello > /tmp/hello\n"
+	d := e.driver(t, map[string]interface{}{"zstack-userdata": script})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	var userData string
+	for _, tag := range e.server.CreateRequest(d.InstanceUUID).SystemTags {
+		if strings.HasPrefix(tag, userDataTagPrefix) {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(tag, userDataTagPrefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			userData = string(decoded)
+		}
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(userData))
+	if err != nil {
+		t.Fatalf("user data is not a MIME document: %v\n%s", err, userData)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	contents := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		contents[mediaType] = string(content)
+	}
+	// the key is only passed by the sshkey tag
+	config := contents["text/cloud-config"]
+	if strings.Contains(config, strings.TrimSpace(string(d.PublicKey))) || !strings.Contains(config, "name: "+sshUser) {
+		t.Errorf("the cloud-config does not make %s the default user, or installs the key:\n%s", sshUser, config)
+	}
+	if contents["text/x-shellscript"] != script {
+		t.Errorf("shell script part = %q, want %q", contents["text/x-shellscript"], script)
+	}
+
+	d = NewDriver(testMachine, e.storePath).(*Driver)
+	err = d.SetConfigFromFlags(&drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"zstack-endpoint":             e.server.URL,
+			"zstack-account-name":         testAccount,
+			"zstack-account-password":     testPassword,
+			"zstack-image-name":           "ubuntu",
+			"zstack-instance-offering":    "small",
+			"zstack-network-name":         "flat",
+			"zstack-system-disk-offering": "root-disk",
+			"zstack-userdata":             "neither cloud-config nor script",
+		},
+		CreateFlags: d.GetCreateFlags(),
+	})
+	if err == nil {
+		t.Error("SetConfigFromFlags accepted user data of unknown type")
+	}
+}
+
+// fakeSSHClient records the commands run over SSH. With key auth it fails
+// unless the key is accepted, as before cloud-init installed it.
+type fakeSSHClient struct {
+	auth      *ssh.Auth
+	acceptKey bool
+	commands  *[]string
+}
+
+func (c *fakeSSHClient) Output(command string) (string, error) {
+	if len(c.auth.Keys) > 0 && !c.acceptKey {
+		return "", errors.New("ssh: unable to authenticate")
+	}
+	*c.commands = append(*c.commands, command)
+	return "", nil
+}
+
+func (c *fakeSSHClient) Shell(args ...string) error { return nil }
+
+func (c *fakeSSHClient) Start(command string) (io.ReadCloser, io.ReadCloser, error) {
+	return nil, nil, nil
+}
+
+func (c *fakeSSHClient) Wait() error { return nil }
+
+// fakeSSH replaces the SSH dialer and returns the auth methods dialed, the
+// commands run and a func which restores the dialer.
+func fakeSSH(acceptKey bool) (*[]string, *[]string, func()) {
+	var auths, commands []string
+	newSSHClient = func(user, host string, port int, auth *ssh.Auth) (ssh.Client, error) {
+		if len(auth.Keys) > 0 {
+			auths = append(auths, "key")
+		} else {
+			auths = append(auths, "password:"+strings.Join(auth.Passwords, ","))
+		}
+		return &fakeSSHClient{auth: auth, acceptKey: acceptKey, commands: &commands}, nil
+	}
+	attempts, interval := keyLoginAttempts, keyLoginInterval
+	keyLoginAttempts, keyLoginInterval = 2, time.Millisecond
+	return &auths, &commands, func() {
+		newSSHClient = ssh.NewClient
+		keyLoginAttempts, keyLoginInterval = attempts, interval
+	}
+}
+
+func TestConfigInstanceKeyLogin(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+	d.PublicKey = []byte("ssh-rsa AAAA test\n")
+	auths, commands, restore := fakeSSH(true)
+	defer restore()
+
+	if err := d.configInstance(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(*auths, ",") != "key" {
+		t.Errorf("logins = %v, want only the key login", *auths)
+	}
+	if strings.Contains(strings.Join(*commands, "\n"), "authorized_keys") {
+		t.Errorf("commands = %v, want no key upload", *commands)
+	}
+}
+
+func TestConfigInstancePasswordFallback(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+	d.PublicKey = []byte("ssh-rsa AAAA test\n")
+	d.SSHPassword = sshPassword
+	auths, commands, restore := fakeSSH(false)
+	defer restore()
+
+	if err := d.configInstance(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(*auths, ",") != "key,password:"+sshPassword {
+		t.Errorf("logins = %v, want the key login then the password login", *auths)
+	}
+	if len(*commands) != 1 || !strings.Contains((*commands)[0], "ssh-rsa AAAA test") {
+		t.Errorf("commands = %v, want the key uploaded with the password login", *commands)
+	}
+}
+
+func TestCreateStaticIP(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, map[string]interface{}{"zstack-static-ip": "flat=10.0.0.100"})
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.IPAddress != "10.0.0.100" {
+		t.Errorf("IPAddress = %q, want the static IP 10.0.0.100", d.IPAddress)
+	}
+
+	tests := map[string]string{
+		"10.0.0.100":        "not available",
+		"10.1.0.5":          "out of the IP ranges",
+		"other=10.0.0.101":  "not found",
+		"10.0.0.5,10.0.0.6": "More than one static IP",
+	}
+	for staticIP, want := range tests {
+		d := e.driver(t, map[string]interface{}{"zstack-static-ip": staticIP})
+		err := d.PreCreateCheck()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("static ip %s: error = %v, want %q", staticIP, err, want)
+		}
+	}
+}
+
+func TestNetworkRoles(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	storage := e.server.AddNamed("l3-networks", "storage")
+
+	tests := []struct {
+		flags       map[string]interface{}
+		wantDefault string
+		wantAddress string
+	}{
+		{map[string]interface{}{}, "storage", "storage"},
+		{map[string]interface{}{"zstack-default-network": "flat"}, "flat", "flat"},
+		{map[string]interface{}{"zstack-address-network": "flat"}, "storage", "flat"},
+	}
+	for _, tt := range tests {
+		tt.flags["zstack-zone-name"] = ""
+		tt.flags["zstack-network-name"] = "storage,flat"
+		d := e.driver(t, tt.flags)
+		if err := d.Create(); err != nil {
+			t.Fatal(err)
+		}
+		flat, err := resolveUUID("l3 network", "flat", d.lookupL3Networks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uuids := map[string]string{"storage": storage, "flat": flat}
+
+		request := e.server.CreateRequest(d.InstanceUUID)
+		if request.Params.DefaultL3NetworkUUID != uuids[tt.wantDefault] {
+			t.Errorf("%v: default network = %s, want %s", tt.flags, request.Params.DefaultL3NetworkUUID, tt.wantDefault)
+		}
+		for _, nic := range e.server.VM(d.InstanceUUID).VMNics {
+			if nic.L3NetworkUUID == uuids[tt.wantAddress] && d.IPAddress != nic.IP {
+				t.Errorf("%v: IPAddress = %s, want %s of the %s network", tt.flags, d.IPAddress, nic.IP, tt.wantAddress)
+			}
+		}
+		if ip, err := d.GetIP(); err != nil || ip != d.IPAddress {
+			t.Errorf("%v: GetIP() = %s, %v, want %s", tt.flags, ip, err, d.IPAddress)
+		}
+	}
+
+	d := e.driver(t, map[string]interface{}{
+		"zstack-zone-name":       "",
+		"zstack-default-network": "storage",
+	})
+	if err := d.PreCreateCheck(); err == nil || !strings.Contains(err.Error(), "not one of the machine's networks") {
+		t.Errorf("PreCreateCheck with a default network the machine is not attached to: %v", err)
+	}
+}
+
+func TestCreateEIP(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddNamed("l3-networks", "public")
+	d := e.driver(t, map[string]interface{}{
+		"zstack-zone-name":   "",
+		"zstack-eip-network": "public",
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	v := e.server.Resource("vips", d.VIPUUID)
+	if v == nil || v["l3NetworkUuid"] != d.EIPNetworkUUID {
+		t.Fatalf("vip = %v, want a vip on l3 network %s", v, d.EIPNetworkUUID)
+	}
+	eip := e.server.Resource("eips", d.EIPUUID)
+	if eip == nil || eip["vmNicUuid"] != e.server.VM(d.InstanceUUID).VMNics[0].UUID {
+		t.Fatalf("eip = %v, want it attached to the nic of the vm", eip)
+	}
+	if d.IPAddress != v["ip"] {
+		t.Errorf("IPAddress = %s, want the eip %s", d.IPAddress, v["ip"])
+	}
+	if ip, err := d.GetIP(); err != nil || ip != v["ip"] {
+		t.Errorf("GetIP() = %s, %v, want the eip %s", ip, err, v["ip"])
+	}
+
+	vipUUID, eipUUID := d.VIPUUID, d.EIPUUID
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.Resource("eips", eipUUID) != nil || e.server.Resource("vips", vipUUID) != nil {
+		t.Error("the eip and vip are left after Remove")
+	}
+}
+
+func TestCreateSecurityGroups(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	unattached := e.server.AddNamed("security-groups", "lab")
+	d := e.driver(t, map[string]interface{}{"zstack-security-group": "lab"})
+	err := d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "not attached") {
+		t.Fatalf("PreCreateCheck error = %v, want the group not attached to the network", err)
+	}
+	if l3s := e.server.Resource("security-groups", unattached)["attachedL3NetworkUuids"]; l3s != nil {
+		t.Errorf("the driver attached the group of the user to %v", l3s)
+	}
+
+	existing := e.server.AddResource("security-groups", map[string]interface{}{
+		"name":                   "office",
+		"attachedL3NetworkUuids": []string{d.AddressL3NetworkUUID},
+	})
+	d = e.driver(t, map[string]interface{}{
+		"zstack-security-group":        "office",
+		"zstack-create-security-group": true,
+		"zstack-security-group-rule":   "80,udp:8000-8100@10.0.0.0/8",
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	nic := e.server.VM(d.InstanceUUID).VMNics[0]
+	for _, uuid := range []string{existing, d.SecurityGroupUUID} {
+		group := e.server.Resource("security-groups", uuid)
+		if group == nil {
+			t.Fatalf("security group %s not found", uuid)
+		}
+		if l3s, _ := group["attachedL3NetworkUuids"].([]interface{}); len(l3s) != 1 || l3s[0] != nic.L3NetworkUUID {
+			t.Errorf("security group %s is attached to %v, want %s", uuid, l3s, nic.L3NetworkUUID)
+		}
+		if nics, _ := group["vmNicUuids"].([]interface{}); len(nics) != 1 || nics[0] != nic.UUID {
+			t.Errorf("security group %s has nics %v, want %s", uuid, nics, nic.UUID)
+		}
+	}
+
+	rules, _ := e.server.Resource("security-groups", d.SecurityGroupUUID)["rules"].([]interface{})
+	var got []string
+	for _, r := range rules {
+		rule := r.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%v:%v-%v@%v", rule["protocol"], rule["startPort"], rule["endPort"], rule["allowedCidr"]))
+	}
+	want := []string{"TCP:22-22@0.0.0.0/0", "TCP:2376-2376@0.0.0.0/0", "TCP:80-80@0.0.0.0/0", "UDP:8000-8100@10.0.0.0/8"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	created := d.SecurityGroupUUID
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.Resource("security-groups", created) != nil {
+		t.Error("the created security group is left after Remove")
+	}
+	if e.server.Resource("security-groups", existing) == nil {
+		t.Error("Remove deleted a security group it did not create")
+	}
+}
+
+func TestAffinityGroup(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	flags := map[string]interface{}{
+		"zstack-affinity-group":        "etcd",
+		"zstack-affinity-group-policy": "antiHard",
+	}
+
+	first := e.driver(t, flags)
+	if err := first.Create(); err != nil {
+		t.Fatal(err)
+	}
+	second := e.driver(t, flags)
+	if err := second.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if first.AffinityGroupUUID == "" || second.AffinityGroupUUID != first.AffinityGroupUUID {
+		t.Fatalf("affinity groups = %q and %q, want one shared group", first.AffinityGroupUUID, second.AffinityGroupUUID)
+	}
+	group := first.AffinityGroupUUID
+	if policy := e.server.Resource("affinity-groups", group)["policy"]; policy != "antiHard" {
+		t.Errorf("group policy = %v, want antiHard", policy)
+	}
+	for _, d := range []*Driver{first, second} {
+		tags := strings.Join(e.server.CreateRequest(d.InstanceUUID).SystemTags, " ")
+		if !strings.Contains(tags, "affinityGroupUuid::"+group) {
+			t.Errorf("create request tags = %s, want the affinity group", tags)
+		}
+	}
+	if usages := e.server.Resource("affinity-groups", group)["usages"].([]interface{}); len(usages) != 2 {
+		t.Errorf("group members = %v, want both vms", usages)
+	}
+
+	d := e.driver(t, map[string]interface{}{"zstack-affinity-group": "etcd"})
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "policy") {
+		t.Errorf("Create joining with another policy: %v", err)
+	}
+
+	if err := first.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if usages := e.server.Resource("affinity-groups", group)["usages"].([]interface{}); len(usages) != 1 {
+		t.Errorf("group members after the first Remove = %v, want one", usages)
+	}
+	if err := second.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.Resource("affinity-groups", group) != nil {
+		t.Error("the empty affinity group is left after Remove")
+	}
+}
+
+func TestAffinityGroupOwnership(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	// parallel creates of a new group settle on one
+	e.server.Script("createAffinityGroup", zstacktest.Behavior{Pending: 3}, zstacktest.Behavior{Pending: 3})
+	drivers := make([]*Driver, 2)
+	errs := make(chan error, len(drivers))
+	for i := range drivers {
+		drivers[i] = e.driver(t, map[string]interface{}{"zstack-affinity-group": "web"})
+		if err := drivers[i].initClients(); err != nil {
+			t.Fatal(err)
+		}
+		go func(d *Driver) {
+			_, err := d.joinAffinityGroup()
+			errs <- err
+		}(drivers[i])
+	}
+	for range drivers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := drivers[0].affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("name", "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || drivers[0].AffinityGroupUUID != groups[0].UUID || drivers[1].AffinityGroupUUID != groups[0].UUID {
+		t.Errorf("groups named web = %d, machines in %s and %s", len(groups), drivers[0].AffinityGroupUUID, drivers[1].AffinityGroupUUID)
+	}
+
+	// a group created for a vm which failed to create is deleted
+	e.server.Script("createVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobFail})
+	failed := e.driver(t, map[string]interface{}{"zstack-affinity-group": "db"})
+	if err := failed.Create(); err == nil {
+		t.Fatal("Create succeeded, want job failure")
+	}
+	if groups, err := failed.affinityGroupClient.QueryAffinityGroups(common.NewQueryParams().Eq("name", "db")); err != nil || len(groups) != 0 {
+		t.Errorf("groups named db after the failed create = %d, %v", len(groups), err)
+	}
+
+	// only groups of this store are deleted
+	other := e.server.AddResource("affinity-groups", map[string]interface{}{
+		"name":        "cache",
+		"description": affinityGroupDescription,
+		"policy":      "antiSoft",
+	})
+	d := e.driver(t, map[string]interface{}{"zstack-affinity-group": "cache"})
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.AffinityGroupUUID != other {
+		t.Fatalf("AffinityGroupUUID = %s, want the existing group %s", d.AffinityGroupUUID, other)
+	}
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.Resource("affinity-groups", other) == nil {
+		t.Error("Remove deleted an affinity group of another store")
+	}
+}
+
+func TestOwnershipTags(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddNamed("l3-networks", "public")
+	e.server.AddResource("disk-offerings", map[string]interface{}{"name": "data-100", "diskSize": 100 << 30, "state": "Enabled"})
+	d := e.driver(t, map[string]interface{}{
+		"zstack-zone-name":             "",
+		"zstack-description":           "rancher node",
+		"zstack-tag":                   "team=infra, env=prod",
+		"zstack-eip-network":           "public",
+		"zstack-create-security-group": true,
+		"zstack-data-disk-size":        "100G,512M",
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if description := e.server.CreateRequest(d.InstanceUUID).Params.Description; description != "rancher node" {
+		t.Errorf("vm description = %q, want the --zstack-description", description)
+	}
+	want := []string{
+		ownerTag,
+		machineTagPrefix + testMachine,
+		driverTagPrefix + Version,
+		storeTagPrefix + storeHash(e.storePath),
+		"team::infra",
+		"env::prod",
+	}
+	resources := map[string]string{
+		"vm":              d.InstanceUUID,
+		"vip":             d.VIPUUID,
+		"eip":             d.EIPUUID,
+		"security group":  d.SecurityGroupUUID,
+		"offering volume": d.DataVolumeUUIDs[0],
+		"created volume":  d.DataVolumeUUIDs[1],
+	}
+	for name, uuid := range resources {
+		tags := strings.Join(e.server.UserTags(uuid), " ")
+		for _, tag := range want {
+			if !strings.Contains(tags, tag) {
+				t.Errorf("%s tags = %s, want %s", name, tags, tag)
+			}
+		}
+	}
+
+	for _, value := range []string{"team", "=infra", "a::b=c"} {
+		if _, err := parseUserTags(value); err == nil {
+			t.Errorf("parseUserTags accepted %q", value)
+		}
+	}
+}
+
+func TestCreatePortForwarding(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	vip := e.server.AddResource("vips", map[string]interface{}{"name": "shared", "ip": "192.168.0.10"})
+	e.server.AddResource("port-forwarding", map[string]interface{}{
+		"vipUuid":      vip,
+		"vipPortStart": 20000,
+		"vipPortEnd":   20000,
+	})
+	d := e.driver(t, map[string]interface{}{
+		"zstack-port-forwarding-vip":   "shared",
+		"zstack-port-forwarding-range": "20000-20010",
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.SSHForwardPort != 20001 || d.DockerForwardPort != 20002 {
+		t.Errorf("forwarded ports = %d, %d, want 20001, 20002", d.SSHForwardPort, d.DockerForwardPort)
+	}
+	if port, _ := d.GetSSHPort(); port != 20001 {
+		t.Errorf("GetSSHPort() = %d, want 20001", port)
+	}
+	if host, _ := d.GetSSHHostname(); host != "192.168.0.10" {
+		t.Errorf("GetSSHHostname() = %s, want the vip 192.168.0.10", host)
+	}
+	if url, _ := d.GetURL(); url != "tcp://192.168.0.10:20002" {
+		t.Errorf("GetURL() = %s, want tcp://192.168.0.10:20002", url)
+	}
+	nic := e.server.VM(d.InstanceUUID).VMNics[0]
+	for _, uuid := range d.PortForwardingRuleUUIDs {
+		rule := e.server.Resource("port-forwarding", uuid)
+		if rule == nil || rule["vmNicUuid"] != nic.UUID {
+			t.Errorf("rule %s = %v, want it on nic %s", uuid, rule, nic.UUID)
+		}
+	}
+
+	rules := d.PortForwardingRuleUUIDs
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range rules {
+		if e.server.Resource("port-forwarding", uuid) != nil {
+			t.Errorf("rule %s is left after Remove", uuid)
+		}
+	}
+	if e.server.Resource("vips", vip) == nil {
+		t.Error("Remove deleted the shared vip")
+	}
+}
+
+func TestCreateDataVolumesBySize(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	offering := e.server.AddResource("disk-offerings", map[string]interface{}{
+		"name":     "data-100",
+		"diskSize": 100 << 30,
+		"state":    "Enabled",
+	})
+	d := e.driver(t, map[string]interface{}{"zstack-data-disk-size": "100G,512M"})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	offerings := e.server.CreateRequest(d.InstanceUUID).Params.DataDiskOfferingUUIDs
+	if len(offerings) != 1 || offerings[0] != offering {
+		t.Errorf("data disk offerings = %v, want [%s]", offerings, offering)
+	}
+	if len(d.DataVolumeUUIDs) != 2 {
+		t.Fatalf("data volumes = %v, want the offering volume and a created one", d.DataVolumeUUIDs)
+	}
+	created := e.server.Resource("volumes", d.DataVolumeUUIDs[1])
+	if created == nil || created["size"] != float64(512<<20) || created["vmInstanceUuid"] != d.InstanceUUID {
+		t.Errorf("created volume = %v, want a 512M volume attached to %s", created, d.InstanceUUID)
+	}
+
+	volumes := d.DataVolumeUUIDs
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range volumes {
+		if e.server.Resource("volumes", uuid) != nil {
+			t.Errorf("data volume %s is left after Remove", uuid)
+		}
+	}
+
+	if _, err := parseSize("12X"); err == nil {
+		t.Error("parseSize accepted 12X")
+	}
+}
+
+func TestDiskLayout(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, map[string]interface{}{
+		"zstack-data-disk-size": "10G,20G",
+		"zstack-disk-layout":    "# docker and longhorn\n1=/var/lib/docker\n2=/var/lib/longhorn:xfs",
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.diskLayout) != 2 {
+		t.Fatalf("disk layout = %v, want two mounts", d.diskLayout)
+	}
+	script := diskLayoutScript(d.diskLayout)
+	for i, want := range []string{
+		"mount_disk " + d.DataVolumeUUIDs[0] + " ext4 /var/lib/docker \"-F\"",
+		"mount_disk " + d.DataVolumeUUIDs[1] + " xfs /var/lib/longhorn \"\"",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("mount %d: the script does not contain %q:\n%s", i, want, script)
+		}
+	}
+	if output, err := exec.Command("sh", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Errorf("the script is not valid shell: %v: %s", err, output)
+	}
+
+	d = e.driver(t, map[string]interface{}{"zstack-disk-layout": "1=/var/lib/docker"})
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "no data volume") {
+		t.Errorf("Create with a layout for a missing volume: %v", err)
+	}
+
+	for _, spec := range []string{"0=/data", "1=relative", "1=/a:btrfs", "1=/a,1=/b", "1=/a,2=/a", "1"} {
+		if _, err := parseDiskLayout(spec); err == nil {
+			t.Errorf("parseDiskLayout accepted %q", spec)
+		}
+	}
+}
+
+func TestRootDiskSize(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddResource("images", map[string]interface{}{"name": "centos", "mediaType": "RootVolumeTemplate", "size": 8 << 30})
+	e.server.AddResource("images", map[string]interface{}{"name": "installer", "mediaType": "ISO"})
+	d := e.driver(t, map[string]interface{}{
+		"zstack-image-name":           "centos",
+		"zstack-system-disk-offering": "",
+		"zstack-root-disk-size":       "100G",
+	})
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.rootVolumeResized {
+		t.Error("the root volume is not marked as resized")
+	}
+	vm := e.server.VM(d.InstanceUUID)
+	if size := e.server.Resource("volumes", vm.RootVolumeUUID)["size"]; size != float64(100<<30) {
+		t.Errorf("root volume size = %v, want 100G", size)
+	}
+
+	d = e.driver(t, map[string]interface{}{"zstack-image-name": "centos", "zstack-root-disk-size": "4G"})
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "can not shrink") {
+		t.Errorf("Create with a smaller root disk: %v", err)
+	}
+
+	d = e.driver(t, map[string]interface{}{"zstack-image-name": "installer", "zstack-system-disk-offering": ""})
+	if err := d.PreCreateCheck(); err == nil || !strings.Contains(err.Error(), "system disk offering is required") {
+		t.Errorf("PreCreateCheck of an ISO without a system disk offering: %v", err)
+	}
+	d = e.driver(t, map[string]interface{}{"zstack-image-name": "installer", "zstack-root-disk-size": "100G"})
+	if err := d.PreCreateCheck(); err == nil || !strings.Contains(err.Error(), "root disk size can not be set") {
+		t.Errorf("PreCreateCheck of an ISO with a root disk size: %v", err)
+	}
+}
+
+func TestInstanceOfferingSpec(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	existing := e.server.AddResource("instance-offerings", map[string]interface{}{
+		"name": "medium", "cpuNum": 2, "memorySize": 4 << 30, "type": "UserVm", "state": "Enabled",
+	})
+	spec := func(cpu int, memory string) map[string]interface{} {
+		return map[string]interface{}{"zstack-instance-offering": "", "zstack-cpu": cpu, "zstack-memory": memory}
+	}
+
+	d := e.driver(t, spec(2, "4G"))
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.InstanceOfferingUUID != existing {
+		t.Errorf("InstanceOfferingUUID = %q, want the existing offering %q", d.InstanceOfferingUUID, existing)
+	}
+
+	d = e.driver(t, spec(4, "8192M"))
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	created := e.server.Resource("instance-offerings", d.InstanceOfferingUUID)
+	if d.InstanceOfferingUUID == existing || created == nil {
+		t.Fatalf("InstanceOfferingUUID = %q, want a new offering", d.InstanceOfferingUUID)
+	}
+	if created["cpuNum"] != float64(4) || created["memorySize"] != float64(8<<30) {
+		t.Errorf("created offering = %v, want 4 CPUs and 8G memory", created)
+	}
+	if tags := strings.Join(e.server.UserTags(d.InstanceOfferingUUID), " "); !strings.Contains(tags, ownerTag) {
+		t.Errorf("created offering tags = %s, want %s", tags, ownerTag)
+	}
+	if vm := e.server.VM(d.InstanceUUID); vm.InstanceOfferingUUID != d.InstanceOfferingUUID {
+		t.Errorf("vm instance offering = %q, want %q", vm.InstanceOfferingUUID, d.InstanceOfferingUUID)
+	}
+
+	d = e.driver(t, spec(4, "8G"))
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if d.InstanceOfferingUUID != created["uuid"] {
+		t.Errorf("InstanceOfferingUUID = %q, want the created offering to be reused", d.InstanceOfferingUUID)
+	}
+
+	// a bare memory size is in MiB
+	d = e.driver(t, spec(2, "4096"))
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if d.InstanceOfferingUUID != existing {
+		t.Errorf("InstanceOfferingUUID = %q, want the existing 4G offering %q", d.InstanceOfferingUUID, existing)
+	}
+	if _, err := parseMemory("lots"); err == nil || !strings.Contains(err.Error(), "memory size") {
+		t.Errorf("parseMemory error = %v, want an invalid memory size", err)
+	}
+
+	for _, flags := range []map[string]interface{}{
+		{"zstack-cpu": 2, "zstack-memory": "4G"},
+		spec(2, ""),
+		spec(0, "4G"),
+		spec(2, "lots"),
+		{"zstack-instance-offering": ""},
+	} {
+		d := NewDriver(testMachine, e.storePath).(*Driver)
+		values := map[string]interface{}{
+			"zstack-account-name":      testAccount,
+			"zstack-account-password":  testPassword,
+			"zstack-endpoint":          e.server.URL,
+			"zstack-image-name":        "ubuntu",
+			"zstack-instance-offering": "small",
+			"zstack-network-name":      "flat",
+		}
+		for k, v := range flags {
+			values[k] = v
+		}
+		opts := &drivers.CheckDriverOptions{FlagsValues: values, CreateFlags: d.GetCreateFlags()}
+		if err := d.SetConfigFromFlags(opts); err == nil {
+			t.Errorf("SetConfigFromFlags accepted %v", flags)
+		}
+	}
+}
+
+func TestInstanceOfferingParallelCreate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.Script("createInstanceOffering", zstacktest.Behavior{Pending: 3}, zstacktest.Behavior{Pending: 3})
+
+	drivers := make([]*Driver, 2)
+	errs := make(chan error, len(drivers))
+	for i := range drivers {
+		drivers[i] = e.driver(t, map[string]interface{}{"zstack-instance-offering": "", "zstack-cpu": 8, "zstack-memory": "16G"})
+		if err := drivers[i].initClients(); err != nil {
+			t.Fatal(err)
+		}
+		go func(d *Driver) {
+			errs <- d.createInstanceOffering()
+		}(drivers[i])
+	}
+	for range drivers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	offerings, err := drivers[0].queryOfferingsBySpec(16 << 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offerings) != 1 || drivers[0].InstanceOfferingUUID != offerings[0].UUID || drivers[1].InstanceOfferingUUID != offerings[0].UUID {
+		t.Errorf("offerings of 8 CPUs and 16G = %d, machines use %s and %s",
+			len(offerings), drivers[0].InstanceOfferingUUID, drivers[1].InstanceOfferingUUID)
+	}
+}
+
+func TestPreCreateCheckAmbiguousName(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddNamed("images", "ubuntu")
+	d := e.driver(t, nil)
+
+	err := d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("PreCreateCheck error = %v, want ambiguous image", err)
+	}
+}
+
+func TestPreCreateCheckNotFound(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, map[string]interface{}{"zstack-network-name": "flat,missing"})
+
+	err := d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), `"missing" not found`) {
+		t.Fatalf("PreCreateCheck error = %v, want missing network", err)
+	}
+}
+
+func TestCreateJobFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.Script("createVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobFail})
+	d := e.driver(t, nil)
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err == nil {
+		t.Fatal("Create succeeded, want job failure")
+	}
+	if d.InstanceUUID != "" {
+		t.Errorf("InstanceUUID = %q after failed create", d.InstanceUUID)
+	}
+}
+
+func TestCreateTimeout(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.Script("createVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobNeverEnds})
+	d := e.driver(t, map[string]interface{}{"zstack-create-timeout": 1})
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Create error = %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Create gave up after %s, want about the 1s timeout", elapsed)
+	}
+	if calls := e.server.Calls(); calls[len(calls)-1] != "createVmInstance" {
+		t.Errorf("calls = %v, want nothing sent after the create timed out", calls)
+	}
+}
+
+func TestRemoveAfterCreateTimeout(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.Script("createVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobNeverEnds})
+	d := e.driver(t, map[string]interface{}{"zstack-create-timeout": 1})
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err == nil {
+		t.Fatal("Create succeeded, want timeout")
+	}
+
+	// the create finished after the driver gave up on it, next to a machine
+	// of the same name in another store
+	late := e.server.AddVM(&instance.VMInstanceInventory{Name: testMachine, State: "Running"})
+	other := e.server.AddVM(&instance.VMInstanceInventory{Name: testMachine, State: "Running"})
+	for _, tag := range d.ownerTags() {
+		e.server.AddResource("user-tags", map[string]interface{}{"resourceType": "VmInstanceVO", "resourceUuid": late, "tag": tag})
+	}
+	for _, tag := range []string{machineTagPrefix + testMachine, storeTagPrefix + "another"} {
+		e.server.AddResource("user-tags", map[string]interface{}{"resourceType": "VmInstanceVO", "resourceUuid": other, "tag": tag})
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.VM(late) != nil {
+		t.Error("the vm of the timed out create is left after Remove")
+	}
+	if e.server.VM(other) == nil {
+		t.Error("Remove deleted the vm of another store")
+	}
+}
+
+func TestStopStart(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.server.VM(d.InstanceUUID).State; got != "Stopped" {
+		t.Errorf("state after Stop = %s", got)
+	}
+
+	e.server.Script("startVmInstance", zstacktest.Behavior{Pending: 1})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.server.VM(d.InstanceUUID).State; got != "Running" {
+		t.Errorf("state after Start = %s", got)
+	}
+}
+
+func TestKill(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	if err := d.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != state.Stopped {
+		t.Errorf("state = %s, want %s", s, state.Stopped)
+	}
+}
+
+func TestStartJobOutcomes(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Stopped")
+
+	e.server.Script("startVmInstance",
+		zstacktest.Behavior{Outcome: zstacktest.JobNotFound},
+		zstacktest.Behavior{Outcome: zstacktest.JobFail},
+	)
+	if err := d.Start(); err == nil || !strings.Contains(err.Error(), "no longer available") {
+		t.Errorf("Start error = %v, want unavailable location", err)
+	}
+	if err := d.Start(); err == nil || !strings.Contains(err.Error(), "startVmInstance failed") {
+		t.Errorf("Start error = %v, want job failure", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if vm := e.server.VM(d.InstanceUUID); vm != nil {
+		t.Errorf("vm still exists in state %s", vm.State)
+	}
+	calls := strings.Join(e.server.Calls(), ",")
+	if !strings.Contains(calls, "destroyVmInstance,expungeVmInstance") {
+		t.Errorf("calls = %s, want destroy then expunge", calls)
+	}
+}
+
+func TestRemoveIdempotent(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, map[string]interface{}{
+		"zstack-create-security-group": true,
+		"zstack-data-disk-size":        "10G",
+	})
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	volumes := d.DataVolumeUUIDs
+	e.server.SetVMState(d.InstanceUUID, "Destroyed")
+	// a machine created before its data volumes were recorded
+	d.DataVolumeUUIDs = nil
+	again := *d
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	calls := strings.Join(e.server.Calls(), ",")
+	if strings.Contains(calls, "destroyVmInstance") || !strings.Contains(calls, "expungeVmInstance") {
+		t.Errorf("calls = %s, want only the expunge of the destroyed vm", calls)
+	}
+	if e.server.VM(d.InstanceUUID) != nil || e.server.Resource("volumes", volumes[0]) != nil {
+		t.Error("the vm or its tagged data volume is left after Remove")
+	}
+
+	// everything is gone already
+	if err := again.Remove(); err != nil {
+		t.Fatalf("second Remove: %v", err)
+	}
+}
+
+func TestRemoveKeepsGoing(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(t, map[string]interface{}{"zstack-create-security-group": true})
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	e.server.Script("deleteSecurityGroup", zstacktest.Behavior{Outcome: zstacktest.JobFail})
+
+	if err := d.Remove(); err == nil || !strings.Contains(err.Error(), "1 of the 2 resources") {
+		t.Fatalf("Remove error = %v, want the security group failure", err)
+	}
+	if e.server.VM(d.InstanceUUID) != nil {
+		t.Error("the vm is left after the security group failed")
+	}
+	if d.SecurityGroupUUID == "" {
+		t.Fatal("the security group which failed to delete is forgotten")
+	}
+
+	group := d.SecurityGroupUUID
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if e.server.Resource("security-groups", group) != nil {
+		t.Error("the security group is left after the retry")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	if err := d.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if d.IPAddress != "10.0.0.2" {
+		t.Errorf("IPAddress = %q after restart", d.IPAddress)
+	}
+	if calls := strings.Join(e.server.Calls(), ","); strings.Contains(calls, "stopVmInstance") {
+		t.Errorf("calls = %s, want a plain reboot", calls)
+	}
+}
+
+func TestRestartFallsBackToStopStart(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+	e.server.Script("rebootVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobFail})
+	e.server.Script("stopVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobFail})
+
+	if err := d.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.server.VM(d.InstanceUUID).State; got != "Running" {
+		t.Errorf("state after restart = %s", got)
+	}
+	calls := strings.Join(e.server.Calls(), ",")
+	if !strings.Contains(calls, "rebootVmInstance,stopVmInstance,stopVmInstance,startVmInstance") {
+		t.Errorf("calls = %s, want reboot, grace stop, cold stop, start", calls)
+	}
+}
+
+func TestRestartLateReboot(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+	d.StartTimeout = 1
+	e.server.Script("rebootVmInstance", zstacktest.Behavior{Outcome: zstacktest.JobNeverEnds})
+
+	// the reboot finishes while its job does not report it
+	go func() {
+		for !strings.Contains(strings.Join(e.server.Calls(), ","), "rebootVmInstance") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		e.server.SetVMState(d.InstanceUUID, "Running")
+	}()
+	if err := d.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Join(e.server.Calls(), ","); strings.Contains(calls, "stopVmInstance") {
+		t.Errorf("calls = %s, want no stop after the late reboot", calls)
+	}
+}
+
+func TestGetState(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	for zstackState, want := range map[instance.VMInstanceState]state.State{
+		instance.VMInstanceStateCreated:   state.Starting,
+		instance.VMInstanceStateStarting:  state.Starting,
+		instance.VMInstanceStateRebooting: state.Starting,
+		instance.VMInstanceStateRunning:   state.Running,
+		instance.VMInstanceStateMigrating: state.Running,
+		instance.VMInstanceStatePaused:    state.Paused,
+		instance.VMInstanceStateStopping:  state.Stopping,
+		instance.VMInstanceStateStopped:   state.Stopped,
+		instance.VMInstanceStateUnknown:   state.Error,
+		instance.VMInstanceStateError:     state.Error,
+		"":                                state.None,
+	} {
+		e.server.SetVMState(d.InstanceUUID, zstackState)
+		got, err := d.GetState()
+		if err != nil {
+			t.Errorf("GetState for %q: %v", zstackState, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("GetState for %q = %s, want %s", zstackState, got, want)
+		}
+	}
+}
+
+func TestGetStateGone(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Destroyed")
+
+	if _, err := d.GetState(); err == nil || !strings.Contains(err.Error(), "destroyed") {
+		t.Errorf("GetState error = %v, want destroyed", err)
+	}
+
+	d.InstanceUUID = zstacktest.NewUUID()
+	if _, err := d.GetState(); err == nil || !strings.Contains(err.Error(), "no longer exists") {
+		t.Errorf("GetState error = %v, want no longer exists", err)
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.existing(t, "Running")
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetState(); err != nil {
+		t.Fatal(err)
+	}
+	if logins := countCalls(e.server, "logInByAccount"); logins != 1 {
+		t.Errorf("%d logins, want all clients to share one session", logins)
+	}
+
+	e.server.ExpireSessions()
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if logins := countCalls(e.server, "logInByAccount"); logins != 2 {
+		t.Errorf("%d logins, want one renewal", logins)
+	}
+}
+
+func countCalls(s *zstacktest.Server, action string) int {
+	n := 0
+	for _, call := range s.Calls() {
+		if call == action {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTLSVerification(t *testing.T) {
+	server := zstacktest.NewTLSServer(testAccount, testPassword)
+	defer server.Close()
+	caFile, err := ioutil.TempFile("", "zstack-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	caFile.Write(server.CertificatePEM())
+	caFile.Close()
+
+	for _, test := range []struct {
+		name    string
+		flags   map[string]interface{}
+		wantErr bool
+	}{
+		{"untrusted", nil, true},
+		{"ca file", map[string]interface{}{"zstack-ca-cert": caFile.Name()}, false},
+		{"ca content", map[string]interface{}{"zstack-ca-cert": string(server.CertificatePEM())}, false},
+		{"insecure", map[string]interface{}{"zstack-insecure": true}, false},
+	} {
+		d := NewDriver(testMachine, "").(*Driver)
+		values := map[string]interface{}{
+			"zstack-account-name":         testAccount,
+			"zstack-account-password":     testPassword,
+			"zstack-endpoint":             server.URL,
+			"zstack-image-name":           "ubuntu",
+			"zstack-instance-offering":    "small",
+			"zstack-network-name":         "flat",
+			"zstack-system-disk-offering": "root-disk",
+		}
+		for k, v := range test.flags {
+			values[k] = v
+		}
+		if err := d.SetConfigFromFlags(&drivers.CheckDriverOptions{
+			FlagsValues: values,
+			CreateFlags: d.GetCreateFlags(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		err := d.initClients()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: initClients error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestAccessKeyAuthentication(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddAccessKey("key-id", "key-secret")
+	d := e.driver(t, map[string]interface{}{
+		"zstack-account-name":      "",
+		"zstack-account-password":  "",
+		"zstack-access-key-id":     "key-id",
+		"zstack-access-key-secret": "key-secret",
+	})
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Password != "" {
+		t.Error("the account password is stored with an AccessKey")
+	}
+	if logins := countCalls(e.server, "logInByAccount"); logins != 0 {
+		t.Errorf("%d logins with an AccessKey", logins)
+	}
+
+	d = e.driver(t, map[string]interface{}{
+		"zstack-access-key-id":     "key-id",
+		"zstack-access-key-secret": "wrong-secret",
+	})
+	if err := d.PreCreateCheck(); err == nil {
+		t.Error("PreCreateCheck succeeded with a wrong AccessKey secret")
+	}
+}
+
+func TestLoginTypes(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddUser(testAccount, "alice", "alice-password")
+	e.server.AddLdapUser("bob", "bob-password")
+	e.server.AddVirtualID("carol", "carol-password")
+	e.server.AddNamed("iam2/projects", "web")
+
+	tests := []struct {
+		name  string
+		flags map[string]interface{}
+		call  string
+	}{
+		{"user", map[string]interface{}{
+			"zstack-login-type":       "user",
+			"zstack-user-name":        "alice",
+			"zstack-account-password": "alice-password",
+		}, "logInByUser"},
+		{"ldap", map[string]interface{}{
+			"zstack-login-type":       "ldap",
+			"zstack-account-name":     "",
+			"zstack-user-name":        "bob",
+			"zstack-account-password": "bob-password",
+		}, "logInByLdap"},
+		{"iam2", map[string]interface{}{
+			"zstack-login-type":       "iam2",
+			"zstack-account-name":     "",
+			"zstack-user-name":        "carol",
+			"zstack-account-password": "carol-password",
+			"zstack-project":          "web",
+		}, "loginIAM2Project:web"},
+	}
+	for _, tt := range tests {
+		d := e.driver(t, tt.flags)
+		if err := d.PreCreateCheck(); err != nil {
+			t.Errorf("%s login: %v", tt.name, err)
+			continue
+		}
+		if countCalls(e.server, tt.call) != 1 {
+			t.Errorf("%s login: expect one %s call, got %v", tt.name, tt.call, e.server.Calls())
+		}
+	}
+
+	d := NewDriver(testMachine, e.storePath).(*Driver)
+	err := d.SetConfigFromFlags(&drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"zstack-endpoint":         e.server.URL,
+			"zstack-login-type":       "user",
+			"zstack-account-name":     testAccount,
+			"zstack-account-password": "alice-password",
+			"zstack-project":          "web",
+		},
+		CreateFlags: d.GetCreateFlags(),
+	})
+	if err == nil {
+		t.Error("SetConfigFromFlags accepted a user login without user name and with a project")
+	}
+}
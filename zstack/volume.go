@@ -0,0 +1,255 @@
+package zstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	primaryStorageForDataVolumeTag = "primaryStorageUuidForDataVolume::%s"
+
+	imageMediaTypeISO = "ISO"
+
+	mib = int64(1) << 20
+	gib = int64(1) << 30
+	tib = int64(1) << 40
+)
+
+// parseSize parses a disk size such as 512M, 100G or 1T; a bare number is
+// in GiB.
+func parseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	unit := gib
+	switch {
+	case strings.HasSuffix(value, "M"):
+		unit = mib
+	case strings.HasSuffix(value, "G"):
+		unit = gib
+	case strings.HasSuffix(value, "T"):
+		unit = tib
+	}
+	number := strings.TrimRight(value, "MGT")
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("Invalid disk size %q, expect e.g. 512M, 100G or 1T.", size)
+	}
+	return n * unit, nil
+}
+
+func parseSizes(values string) ([]int64, error) {
+	var sizes []int64
+	for _, value := range splitList(values) {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// checkImage requires a system disk offering for ISO images, which have no
+// root volume of their own, while a root disk size only applies to images
+// with one.
+func (d *Driver) checkImage() error {
+	images, err := d.imageClient.QueryImages(common.NewQueryParams().Eq("uuid", d.ImageUUID))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query image %s.", d.ImageUUID)
+	}
+	if len(images) == 0 {
+		return errors.Errorf("image %s not found", d.ImageUUID)
+	}
+	if images[0].MediaType != imageMediaTypeISO {
+		return nil
+	}
+	if d.SystemDiskOfferingUUID == "" {
+		return errors.Errorf("The system disk offering is required with the ISO image %s.", images[0].Name)
+	}
+	if d.RootDiskSize != "" {
+		return errors.Errorf("The root disk size can not be set with the ISO image %s, use the system disk offering instead.", images[0].Name)
+	}
+	return nil
+}
+
+// resizeRootVolume expands the root volume of the new VM to the root disk
+// size, the guest file system is grown by configInstance.
+func (d *Driver) resizeRootVolume(inventory *instance.VMInstanceInventory) error {
+	if d.RootDiskSize == "" {
+		return nil
+	}
+	size, err := parseSize(d.RootDiskSize)
+	if err != nil {
+		return err
+	}
+
+	var root *instance.Volume
+	for _, v := range inventory.AllVolumes {
+		if v.UUID == inventory.RootVolumeUUID || (inventory.RootVolumeUUID == "" && v.Type == volume.VolumeTypeRoot) {
+			root = v
+		}
+	}
+	if root == nil {
+		return errors.Errorf("The instance %s has no root volume to resize.", d.InstanceUUID)
+	}
+	if size == root.Size {
+		return nil
+	}
+	if size < root.Size {
+		return errors.Errorf("The root disk size %s is smaller than the %d MiB of the image, a root volume can not shrink.",
+			d.RootDiskSize, root.Size/mib)
+	}
+
+	async, err := d.volumeClient.ResizeRootVolume(root.UUID, size)
+	if err == nil {
+		err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Get error when resize the root volume.")
+	}
+	log.Infof("Resized the root volume of instance %s to %d MiB", d.InstanceUUID, size/mib)
+	d.rootVolumeResized = true
+	return nil
+}
+
+// resolveDataDiskSizes picks an enabled disk offering of the exact size for
+// every --zstack-data-disk-size, the sizes without one are created as data
+// volumes after the VM.
+func (d *Driver) resolveDataDiskSizes() error {
+	if len(d.DataDiskSizeOfferingUUIDs) > 0 || len(d.DataVolumeSizes) > 0 {
+		return nil
+	}
+	sizes, err := parseSizes(d.DataDiskSize)
+	if err != nil {
+		return err
+	}
+
+	for _, size := range sizes {
+		params := common.NewQueryParams().
+			Eq("diskSize", strconv.FormatInt(size, 10)).
+			Eq("state", "Enabled").
+			SetFields("uuid", "name")
+		offerings, err := d.volumeOfferingClient.QueryDiskOfferings(params)
+		if err != nil {
+			return errors.Wrap(err, "Get error when query disk offerings.")
+		}
+		if len(offerings) > 0 {
+			log.Debugf("Use disk offering %s for a %d bytes data disk", offerings[0].UUID, size)
+			d.DataDiskSizeOfferingUUIDs = append(d.DataDiskSizeOfferingUUIDs, offerings[0].UUID)
+		} else {
+			d.DataVolumeSizes = append(d.DataVolumeSizes, size)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) dataDiskPrimaryStorageUUID() string {
+	if d.DataDiskPrimaryStorageUUID != "" {
+		return d.DataDiskPrimaryStorageUUID
+	}
+	return d.PrimaryStorageUUID
+}
+
+// createDataVolumes creates and attaches the data volumes without a disk
+// offering, and records every data volume of the VM for Remove.
+func (d *Driver) createDataVolumes(inventory *instance.VMInstanceInventory) error {
+	for _, v := range inventory.AllVolumes {
+		if v.Type == volume.VolumeTypeData {
+			d.trackDataVolume(v.UUID)
+			if err := d.tagResource(tag.ResourceTypeVolume, v.UUID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, size := range d.DataVolumeSizes {
+		request := volume.CreateDataVolumeRequest{}
+		request.Params.Name = fmt.Sprintf("%s-data-%d", d.MachineName, i+1)
+		request.Params.DiskSize = size
+		request.Params.PrimaryStorageUUID = d.dataDiskPrimaryStorageUUID()
+		request.UserTags = d.ownerTags()
+		async, err := d.volumeClient.CreateDataVolume(request)
+		if err != nil {
+			return errors.Wrap(err, "Get error when create data volume in zstack.")
+		}
+		response := volume.Response{}
+		if err = waitForJob(async, &response, d.CreateTimeout, defaultCreateTimeout); err != nil {
+			return errors.Wrap(err, "Get error when create data volume in zstack.")
+		}
+		if response.Error != nil {
+			return errors.Wrap(response.Error.WrapError(), "Get error when create data volume in zstack.")
+		}
+		d.trackDataVolume(response.Inventory.UUID)
+
+		async, err = d.volumeClient.AttachDataVolume(response.Inventory.UUID, d.InstanceUUID)
+		if err == nil {
+			err = finishJob(async, d.CreateTimeout, defaultCreateTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when attach data volume %s to the vm instance.", response.Inventory.UUID)
+		}
+		log.Infof("Attached a %d MiB data volume to instance %s", size/mib, d.InstanceUUID)
+	}
+	return nil
+}
+
+func (d *Driver) trackDataVolume(uuid string) {
+	for _, tracked := range d.DataVolumeUUIDs {
+		if tracked == uuid {
+			return
+		}
+	}
+	d.DataVolumeUUIDs = append(d.DataVolumeUUIDs, uuid)
+}
+
+// removeDataVolumes deletes and expunges the data volumes of the machine,
+// they are only detached when the VM is destroyed. Volumes already in the
+// recycle bin are only expunged.
+func (d *Driver) removeDataVolumes(summary *removeSummary) {
+	var left []string
+	for _, uuid := range d.DataVolumeUUIDs {
+		if err := d.removeDataVolume(summary, uuid); err != nil {
+			summary.fail("data volume", uuid, err)
+			left = append(left, uuid)
+		}
+	}
+	d.DataVolumeUUIDs = left
+}
+
+func (d *Driver) removeDataVolume(summary *removeSummary, uuid string) error {
+	volumes, err := d.volumeClient.QueryVolumes(common.NewQueryParams().Eq("uuid", uuid))
+	if err != nil {
+		return errors.Wrapf(err, "Get error when query data volume %s.", uuid)
+	}
+	if len(volumes) == 0 {
+		summary.record("data volume", uuid, resultGone)
+		return nil
+	}
+
+	if volumes[0].Status != volume.VolumeStatusDeleted {
+		async, err := d.volumeClient.DeleteDataVolume(uuid)
+		if err == nil {
+			err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Get error when delete data volume %s.", uuid)
+		}
+	}
+	async, err := d.volumeClient.ExpungeDataVolume(uuid)
+	if err == nil {
+		err = finishJob(async, d.DeleteTimeout, defaultDeleteTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Get error when expunge data volume %s.", uuid)
+	}
+	summary.record("data volume", uuid, resultRemoved)
+	return nil
+}
@@ -0,0 +1,86 @@
+package zstacktest
+
+import (
+	"net/http"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance/affinitygroup"
+)
+
+// Affinity groups are kept in the "affinity-groups" resources, their
+// members in the usages of the group. They are listed in creation order,
+// which is what the driver asks for with sort=+createDate.
+func (s *Server) serveAffinityGroups(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := affinitygroup.CreateAffinityGroupRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := &affinitygroup.AffinityGroupInventory{
+			Name:        request.Params.Name,
+			Description: request.Params.Description,
+			Policy:      request.Params.Policy,
+			Type:        request.Params.Type,
+			State:       "Enabled",
+		}
+		inventory.UUID = NewUUID()
+		s.startJob(w, "createAffinityGroup", func() interface{} {
+			s.addUserTags("AffinityGroupVO", inventory.UUID, request.UserTags)
+			s.resources["affinity-groups"] = append(s.resources["affinity-groups"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "affinity-groups", "deleteAffinityGroup", parts[0])
+	case len(parts) == 3 && parts[1] == "vm-instances" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		group := s.findResource("affinity-groups", parts[0])
+		if group == nil || s.vms[parts[2]] == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "affinity group or vm instance not found")
+			return
+		}
+		s.startJob(w, "addVmToAffinityGroup", func() interface{} {
+			s.addAffinityGroupUsage(group, parts[2])
+			return group
+		})
+	case len(parts) == 2 && parts[1] == "vm-instances" && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		group := s.findResource("affinity-groups", parts[0])
+		if group == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "affinity group "+parts[0]+" not found")
+			return
+		}
+		removed := map[string]bool{}
+		for _, uuid := range r.URL.Query()["uuids"] {
+			removed[uuid] = true
+		}
+		s.startJob(w, "removeVmFromAffinityGroup", func() interface{} {
+			usages, _ := group["usages"].([]interface{})
+			kept := []interface{}{}
+			for _, usage := range usages {
+				if uuid, _ := usage.(map[string]interface{})["resourceUuid"].(string); !removed[uuid] {
+					kept = append(kept, usage)
+				}
+			}
+			group["usages"] = kept
+			return nil
+		})
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "affinity-groups")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) addAffinityGroupUsage(group map[string]interface{}, vmUUID string) {
+	usages, _ := group["usages"].([]interface{})
+	group["usages"] = append(usages, toMap(&affinitygroup.UsageEntry{
+		AffinityGroupUUID: group["uuid"].(string),
+		ResourceUUID:      vmUUID,
+		ResourceType:      "VmInstanceVO",
+	}))
+}
@@ -0,0 +1,294 @@
+package zstacktest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/eip"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/portforwarding"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/securitygroup"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/network/vip"
+)
+
+// Resource returns a copy of the inventory uuid of collection, nil if it
+// does not exist.
+func (s *Server) Resource(collection, uuid string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inventory := s.findResource(collection, uuid)
+	if inventory == nil {
+		return nil
+	}
+	c := map[string]interface{}{}
+	for k, v := range inventory {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *Server) findResource(collection, uuid string) map[string]interface{} {
+	for _, inventory := range s.resources[collection] {
+		if inventory["uuid"] == uuid {
+			return inventory
+		}
+	}
+	return nil
+}
+
+// removeResource removes the inventory and, like ZStack, its user tags.
+func (s *Server) removeResource(collection, uuid string) {
+	inventories := s.resources[collection][:0]
+	for _, inventory := range s.resources[collection] {
+		if inventory["uuid"] != uuid {
+			inventories = append(inventories, inventory)
+		}
+	}
+	s.resources[collection] = inventories
+	if collection != "user-tags" {
+		s.removeUserTags(uuid)
+	}
+}
+
+// deleteResource answers a DELETE of a resource with an async job.
+func (s *Server) deleteResource(w http.ResponseWriter, collection, action, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findResource(collection, uuid) == nil {
+		writeError(w, http.StatusNotFound, "SYS.1001", collection+" "+uuid+" not found")
+		return
+	}
+	s.startJob(w, action, func() interface{} {
+		s.removeResource(collection, uuid)
+		return nil
+	})
+}
+
+func (s *Server) serveVips(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := vip.CreateVipRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := &vip.VipInventory{
+			Name:          request.Params.Name,
+			L3NetworkUUID: request.Params.L3NetworkUUID,
+			IP:            request.Params.RequiredIP,
+			State:         "Enabled",
+		}
+		inventory.UUID = NewUUID()
+		if inventory.IP == "" {
+			inventory.IP = fmt.Sprintf("172.20.0.%d", s.nextIP)
+			s.nextIP++
+		}
+		s.startJob(w, "createVip", func() interface{} {
+			s.addUserTags("VipVO", inventory.UUID, request.UserTags)
+			s.resources["vips"] = append(s.resources["vips"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "vips", "deleteVip", parts[0])
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "vips")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) serveEips(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := eip.CreateEipRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("vips", request.Params.VipUUID)
+		if v == nil {
+			writeError(w, http.StatusBadRequest, "SYS.1001", "vip "+request.Params.VipUUID+" not found")
+			return
+		}
+		inventory := &eip.EipInventory{
+			Name:      request.Params.Name,
+			VipUUID:   request.Params.VipUUID,
+			VMNicUUID: request.Params.VMNicUUID,
+			VipIP:     v["ip"].(string),
+			State:     "Enabled",
+		}
+		inventory.UUID = NewUUID()
+		s.startJob(w, "createEip", func() interface{} {
+			s.addUserTags("EipVO", inventory.UUID, request.UserTags)
+			s.resources["eips"] = append(s.resources["eips"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 4 && parts[1] == "vm-instances" && parts[2] == "nics" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := s.findResource("eips", parts[0])
+		if inventory == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "eip "+parts[0]+" not found")
+			return
+		}
+		s.startJob(w, "attachEip", func() interface{} {
+			inventory["vmNicUuid"] = parts[3]
+			return inventory
+		})
+	case len(parts) == 3 && parts[1] == "vm-instances" && parts[2] == "nics" && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := s.findResource("eips", parts[0])
+		if inventory == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "eip "+parts[0]+" not found")
+			return
+		}
+		s.startJob(w, "detachEip", func() interface{} {
+			delete(inventory, "vmNicUuid")
+			return inventory
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "eips", "deleteEip", parts[0])
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "eips")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// Security groups keep their rules, attached L3 networks and member NICs in
+// "rules", "attachedL3NetworkUuids" and "vmNicUuids".
+func (s *Server) serveSecurityGroups(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := securitygroup.CreateSecurityGroupRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := &securitygroup.SecurityGroupInventory{
+			Name:        request.Params.Name,
+			Description: request.Params.Description,
+			State:       "Enabled",
+		}
+		inventory.UUID = NewUUID()
+		s.startJob(w, "createSecurityGroup", func() interface{} {
+			s.addUserTags("SecurityGroupVO", inventory.UUID, request.UserTags)
+			s.resources["security-groups"] = append(s.resources["security-groups"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "security-groups", "deleteSecurityGroup", parts[0])
+	case len(parts) >= 2 && r.Method == http.MethodPost:
+		s.updateSecurityGroup(w, r, parts)
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "security-groups")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) updateSecurityGroup(w http.ResponseWriter, r *http.Request, parts []string) {
+	var (
+		action string
+		key    string
+		values []interface{}
+	)
+	switch {
+	case len(parts) == 2 && parts[1] == "rules":
+		request := securitygroup.AddRulesRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		action, key = "addSecurityGroupRule", "rules"
+		for _, rule := range request.Params.Rules {
+			values = append(values, toMap(rule))
+		}
+	case len(parts) == 3 && parts[1] == "l3-networks":
+		action, key, values = "attachSecurityGroupToL3Network", "attachedL3NetworkUuids", []interface{}{parts[2]}
+	case len(parts) == 3 && parts[1] == "vm-instances" && parts[2] == "nics":
+		request := securitygroup.AddVMNicsRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		action, key = "addVmNicToSecurityGroup", "vmNicUuids"
+		for _, nic := range request.Params.VMNicUUIDs {
+			values = append(values, nic)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inventory := s.findResource("security-groups", parts[0])
+	if inventory == nil {
+		writeError(w, http.StatusNotFound, "SYS.1001", "security group "+parts[0]+" not found")
+		return
+	}
+	s.startJob(w, action, func() interface{} {
+		existing, _ := inventory[key].([]interface{})
+		inventory[key] = append(existing, values...)
+		return inventory
+	})
+}
+
+func (s *Server) servePortForwarding(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := portforwarding.CreateRuleRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("vips", request.Params.VipUUID)
+		if v == nil {
+			writeError(w, http.StatusBadRequest, "SYS.1001", "vip "+request.Params.VipUUID+" not found")
+			return
+		}
+		for _, rule := range s.resources["port-forwarding"] {
+			start, end := rule["vipPortStart"].(float64), rule["vipPortEnd"].(float64)
+			if rule["vipUuid"] == request.Params.VipUUID &&
+				float64(request.Params.VipPortStart) <= end && float64(request.Params.VipPortEnd) >= start {
+				writeError(w, http.StatusBadRequest, "PORTFORWARDING.1000",
+					fmt.Sprintf("vip port %d is used", request.Params.VipPortStart))
+				return
+			}
+		}
+		p := request.Params
+		inventory := &portforwarding.RuleInventory{
+			Name:             p.Name,
+			VipUUID:          p.VipUUID,
+			VipIP:            v["ip"].(string),
+			VipPortStart:     p.VipPortStart,
+			VipPortEnd:       p.VipPortEnd,
+			PrivatePortStart: p.PrivatePortStart,
+			PrivatePortEnd:   p.PrivatePortEnd,
+			ProtocolType:     p.ProtocolType,
+			VMNicUUID:        p.VMNicUUID,
+			State:            "Enabled",
+		}
+		inventory.UUID = NewUUID()
+		s.startJob(w, "createPortForwardingRule", func() interface{} {
+			s.addUserTags("PortForwardingRuleVO", inventory.UUID, request.UserTags)
+			s.resources["port-forwarding"] = append(s.resources["port-forwarding"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "port-forwarding", "deletePortForwardingRule", parts[0])
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "port-forwarding")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
@@ -0,0 +1,782 @@
+// Package zstacktest provides an in-process stand-in for the ZStack
+// management node, so the driver can be exercised without a real cloud.
+package zstacktest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/common"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+)
+
+const (
+	apiPrefix      = "/zstack/v1/"
+	jobsPath       = "api-jobs"
+	vmInstancePath = "vm-instances"
+)
+
+// JobOutcome decides how an async job finishes when its location is polled.
+type JobOutcome int
+
+const (
+	// JobSucceed completes the job with a 200 and the job result.
+	JobSucceed JobOutcome = iota
+	// JobFail completes the job with a 503 carrying a ZStack error.
+	JobFail
+	// JobNotFound makes the job location answer 404.
+	JobNotFound
+	// JobNeverEnds keeps answering 202 on every poll.
+	JobNeverEnds
+)
+
+// Behavior scripts the next async job of an API action, e.g.
+// "createVmInstance" or "stopVmInstance".
+type Behavior struct {
+	Outcome JobOutcome
+	// Pending is the number of polls answered with 202 before the job ends.
+	Pending int
+	// Error is returned by JobFail; a generic error is used when nil.
+	Error *common.Error
+}
+
+type job struct {
+	action   string
+	behavior Behavior
+	polls    int
+	finish   func() interface{}
+	result   interface{}
+	done     bool
+}
+
+// Server is a fake ZStack management node backed by httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	AccountName string
+	Password    string
+
+	mu             sync.Mutex
+	accessKeys     map[string]string
+	logins         map[string]string
+	sessions       map[string]bool
+	jobs           map[string]*job
+	scripts        map[string][]Behavior
+	vms            map[string]*instance.VMInstanceInventory
+	createRequests map[string]instance.CreateRequest
+	resources      map[string][]map[string]interface{}
+	calls          []string
+	nextIP         int
+}
+
+// NewServer starts a fake ZStack server accepting the given account.
+// The caller must Close it.
+func NewServer(accountName, password string) *Server {
+	s := newServer(accountName, password)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer is like NewServer but serves HTTPS with a self-signed
+// certificate, see CertificatePEM.
+func NewTLSServer(accountName, password string) *Server {
+	s := newServer(accountName, password)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// CertificatePEM returns the PEM encoded certificate of a TLS server.
+func (s *Server) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+func newServer(accountName, password string) *Server {
+	return &Server{
+		AccountName:    accountName,
+		Password:       password,
+		accessKeys:     map[string]string{},
+		logins:         map[string]string{"logInByAccount:" + accountName: hashPassword(password)},
+		sessions:       map[string]bool{},
+		jobs:           map[string]*job{},
+		scripts:        map[string][]Behavior{},
+		vms:            map[string]*instance.VMInstanceInventory{},
+		createRequests: map[string]instance.CreateRequest{},
+		resources:      map[string][]map[string]interface{}{},
+		nextIP:         10,
+	}
+}
+
+// NewUUID returns a random ZStack style UUID.
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// Script queues behaviors for the next jobs of action. Jobs without a
+// scripted behavior succeed immediately.
+func (s *Server) Script(action string, behaviors ...Behavior) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[action] = append(s.scripts[action], behaviors...)
+}
+
+// AddResource registers an inventory under a collection such as "zones" or
+// "l3-networks" and returns its UUID.
+func (s *Server) AddResource(collection string, inventory map[string]interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid, _ := inventory["uuid"].(string)
+	if uuid == "" {
+		uuid = NewUUID()
+		inventory["uuid"] = uuid
+	}
+	// store it as decoded JSON like the resources created through the API
+	s.resources[collection] = append(s.resources[collection], toMap(inventory))
+	return uuid
+}
+
+// AddNamed is a shortcut for AddResource with only a name.
+func (s *Server) AddNamed(collection, name string) string {
+	return s.AddResource(collection, map[string]interface{}{"name": name})
+}
+
+// AddVM registers an existing VM instance and returns its UUID.
+func (s *Server) AddVM(vm *instance.VMInstanceInventory) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm.UUID == "" {
+		vm.UUID = NewUUID()
+	}
+	s.vms[vm.UUID] = vm
+	return vm.UUID
+}
+
+// VM returns a copy of the VM instance, or nil if it does not exist.
+func (s *Server) VM(uuid string) *instance.VMInstanceInventory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[uuid]
+	if !ok {
+		return nil
+	}
+	c := *vm
+	return &c
+}
+
+// CreateRequest returns the request the VM uuid was created with.
+func (s *Server) CreateRequest(uuid string) instance.CreateRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createRequests[uuid]
+}
+
+// SetVMState forces the state of a VM instance.
+func (s *Server) SetVMState(uuid string, state instance.VMInstanceState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm, ok := s.vms[uuid]; ok {
+		vm.State = state
+	}
+}
+
+// Calls returns the API actions received so far, e.g. "createVmInstance".
+func (s *Server) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// Sessions returns the number of sessions currently logged in.
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// AddAccessKey accepts requests signed with the AccessKey.
+func (s *Server) AddAccessKey(id, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessKeys[id] = secret
+}
+
+// ExpireSessions invalidates every session, as ZStack does when they time
+// out.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/login") && r.Method == http.MethodPost:
+		s.login(w, r)
+		return
+	case parts[0] == jobsPath && len(parts) == 2 && r.Method == http.MethodGet:
+		s.pollJob(w, parts[1])
+		return
+	}
+
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "ID.1001", "session expired or invalid")
+		return
+	}
+
+	switch {
+	case parts[0] == "accounts" && len(parts) == 3 && parts[1] == "sessions" && r.Method == http.MethodDelete:
+		s.logout(w, parts[2])
+	case r.URL.Path == apiPrefix+"iam2/projects/login" && r.Method == http.MethodPut:
+		s.loginProject(w, r)
+	case parts[0] == vmInstancePath:
+		s.serveVMInstances(w, r, parts[1:])
+	case parts[0] == "vips":
+		s.serveVips(w, r, parts[1:])
+	case parts[0] == "eips":
+		s.serveEips(w, r, parts[1:])
+	case parts[0] == "security-groups":
+		s.serveSecurityGroups(w, r, parts[1:])
+	case parts[0] == "port-forwarding":
+		s.servePortForwarding(w, r, parts[1:])
+	case parts[0] == "user-tags":
+		s.serveUserTags(w, r, parts[1:])
+	case parts[0] == "tags" && len(parts) == 2 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "user-tags", "deleteTag", parts[1])
+	case parts[0] == "affinity-groups":
+		s.serveAffinityGroups(w, r, parts[1:])
+	case parts[0] == "instance-offerings" && len(parts) == 1 && r.Method == http.MethodPost:
+		s.createOffering(w, r)
+	case parts[0] == "instance-offerings" && len(parts) == 2 && r.Method == http.MethodDelete:
+		s.deleteResource(w, "instance-offerings", "deleteInstanceOffering", parts[1])
+	case parts[0] == "volumes":
+		s.serveVolumes(w, r, parts[1:])
+	case parts[0] == "l3-networks" && len(parts) == 5 && parts[4] == "availability" && r.Method == http.MethodGet:
+		s.checkIPAvailability(w, parts[1], parts[3])
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, strings.Join(parts, "/"))
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// AddUser accepts the login of an IAM user of account.
+func (s *Server) AddUser(account, user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins["logInByUser:"+account+"/"+user] = hashPassword(password)
+}
+
+// AddLdapUser accepts the LDAP login of uid.
+func (s *Server) AddLdapUser(uid, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins["logInByLdap:"+uid] = password
+}
+
+// AddVirtualID accepts the login of an IAM2 virtual ID. Its projects are
+// registered with AddNamed("iam2/projects", name).
+func (s *Server) AddVirtualID(name, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins["loginIAM2VirtualID:"+name] = hashPassword(password)
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	body := map[string]map[string]string{}
+	if err := decodeBody(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+		return
+	}
+
+	var kind, identity string
+	for kind = range body {
+		if kind != "systemTags" && kind != "userTags" {
+			break
+		}
+	}
+	params := body[kind]
+	switch kind {
+	case "logInByAccount":
+		identity = params["accountName"]
+	case "logInByUser":
+		identity = params["accountName"] + "/" + params["userName"]
+	case "logInByLdap":
+		identity = params["uid"]
+	case "loginIAM2VirtualID":
+		identity = params["name"]
+	}
+
+	s.mu.Lock()
+	password, ok := s.logins[kind+":"+identity]
+	s.mu.Unlock()
+	if !ok || params["password"] != password {
+		writeError(w, http.StatusBadRequest, "ID.1000", "wrong account name or password")
+		return
+	}
+	s.newSession(w, kind)
+}
+
+func (s *Server) loginProject(w http.ResponseWriter, r *http.Request) {
+	body := map[string]map[string]string{}
+	if err := decodeBody(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+		return
+	}
+	name := body["loginIAM2Project"]["projectName"]
+
+	s.mu.Lock()
+	found := len(filter(s.resources["iam2/projects"], []string{"name=" + name})) == 1
+	s.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusBadRequest, "IAM2.1000", "project "+name+" not found")
+		return
+	}
+	s.newSession(w, "loginIAM2Project:"+name)
+}
+
+func (s *Server) newSession(w http.ResponseWriter, call string) {
+	session := NewUUID()
+	s.mu.Lock()
+	s.sessions[session] = true
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"inventory": map[string]string{"uuid": session},
+	})
+}
+
+func (s *Server) logout(w http.ResponseWriter, session string) {
+	s.mu.Lock()
+	delete(s.sessions, session)
+	s.calls = append(s.calls, "logOut")
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(authorization, "ZStack ") {
+		parts := strings.SplitN(strings.TrimPrefix(authorization, "ZStack "), ":", 2)
+		secret, ok := s.accessKeys[parts[0]]
+		if !ok || len(parts) != 2 {
+			return false
+		}
+		mac := hmac.New(sha1.New, []byte(secret))
+		io.WriteString(mac, r.Method+"\n"+r.Header.Get("Date")+"\n"+strings.TrimPrefix(r.URL.Path, "/zstack"))
+		return parts[1] == base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return s.sessions[strings.TrimPrefix(authorization, "OAuth ")]
+}
+
+func (s *Server) serveVMInstances(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.createVM(w, r)
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.queryVMs(w, r, "")
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.queryVMs(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.destroyVM(w, parts[0])
+	case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPut:
+		s.vmAction(w, r, parts[0])
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) createOffering(w http.ResponseWriter, r *http.Request) {
+	request := instance.CreateOfferingRequest{}
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inventory := &instance.OfferingInventory{
+		Name:        request.Params.Name,
+		Description: request.Params.Description,
+		CPUNum:      request.Params.CPUNum,
+		MemorySize:  request.Params.MemorySize,
+		Type:        request.Params.Type,
+		State:       "Enabled",
+	}
+	inventory.UUID = NewUUID()
+	s.startJob(w, "createInstanceOffering", func() interface{} {
+		s.addUserTags("InstanceOfferingVO", inventory.UUID, request.UserTags)
+		s.resources["instance-offerings"] = append(s.resources["instance-offerings"], toMap(inventory))
+		return inventory
+	})
+}
+
+func (s *Server) createVM(w http.ResponseWriter, r *http.Request) {
+	request := instance.CreateRequest{}
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := &instance.VMInstanceInventory{
+		Name:                 request.Params.Name,
+		Description:          request.Params.Description,
+		ZoneUUID:             request.Params.ZoneUUID,
+		ClusterUUID:          request.Params.ClusterUUID,
+		HostUUID:             request.Params.HostUUID,
+		ImageUUID:            request.Params.ImageUUID,
+		InstanceOfferingUUID: request.Params.InstanceOfferingUUID,
+		DefaultL3NetworkUUID: request.Params.DefaultL3NetworkUUID,
+		State:                "Starting",
+	}
+	vm.UUID = NewUUID()
+	if vm.DefaultL3NetworkUUID == "" && len(request.Params.L3NetworkUUIDs) > 0 {
+		vm.DefaultL3NetworkUUID = request.Params.L3NetworkUUIDs[0]
+	}
+	staticIPs := map[string]string{}
+	for _, tag := range request.SystemTags {
+		if fields := strings.Split(tag, "::"); len(fields) == 3 && fields[0] == "staticIp" {
+			staticIPs[fields[1]] = fields[2]
+		}
+	}
+	for i, l3 := range request.Params.L3NetworkUUIDs {
+		nic := &instance.VMNic{
+			VMInstanceUUID: vm.UUID,
+			L3NetworkUUID:  l3,
+			IP:             fmt.Sprintf("10.0.%d.%d", i, s.nextIP),
+			DeviceID:       i,
+		}
+		if ip, ok := staticIPs[l3]; ok {
+			nic.IP = ip
+		}
+		nic.UUID = NewUUID()
+		vm.VMNics = append(vm.VMNics, nic)
+	}
+	s.nextIP++
+	vm.RootVolumeUUID = NewUUID()
+	// the root volume has the size of the image
+	rootSize, _ := s.findResource("images", request.Params.ImageUUID)["size"].(float64)
+	vm.AllVolumes = append(vm.AllVolumes, &instance.Volume{
+		Type:           "Root",
+		VMInstanceUUID: vm.UUID,
+		Size:           int64(rootSize),
+		Status:         "Ready",
+	})
+	vm.AllVolumes[0].UUID = vm.RootVolumeUUID
+	for _, offering := range request.Params.DataDiskOfferingUUIDs {
+		size, _ := s.findResource("disk-offerings", offering)["diskSize"].(float64)
+		v := &instance.Volume{
+			Type:             "Data",
+			VMInstanceUUID:   vm.UUID,
+			DiskOfferingUUID: offering,
+			Size:             int64(size),
+			DeviceID:         len(vm.AllVolumes),
+			Status:           "Ready",
+		}
+		v.UUID = NewUUID()
+		vm.AllVolumes = append(vm.AllVolumes, v)
+	}
+
+	s.startJob(w, "createVmInstance", func() interface{} {
+		s.addUserTags("VmInstanceVO", vm.UUID, request.UserTags)
+		for _, tag := range request.SystemTags {
+			if fields := strings.Split(tag, "::"); len(fields) == 2 && fields[0] == "affinityGroupUuid" {
+				if group := s.findResource("affinity-groups", fields[1]); group != nil {
+					s.addAffinityGroupUsage(group, vm.UUID)
+				}
+			}
+		}
+		for _, v := range vm.AllVolumes {
+			s.resources["volumes"] = append(s.resources["volumes"], toMap(v))
+		}
+		vm.State = "Running"
+		s.vms[vm.UUID] = vm
+		s.createRequests[vm.UUID] = request
+		return vm
+	})
+}
+
+func (s *Server) queryVMs(w http.ResponseWriter, r *http.Request, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inventories := []map[string]interface{}{}
+	for _, vm := range s.vms {
+		if uuid != "" && vm.UUID != uuid {
+			continue
+		}
+		inventories = append(inventories, toMap(vm))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"inventories": filter(inventories, r.URL.Query()["q"]),
+	})
+}
+
+func (s *Server) destroyVM(w http.ResponseWriter, uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, "SYS.1001", "vm instance "+uuid+" not found")
+		return
+	}
+	s.startJob(w, "destroyVmInstance", func() interface{} {
+		vm.State = "Destroyed"
+		return nil
+	})
+}
+
+func (s *Server) vmAction(w http.ResponseWriter, r *http.Request, uuid string) {
+	body := map[string]json.RawMessage{}
+	if err := decodeBody(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, "SYS.1001", "vm instance "+uuid+" not found")
+		return
+	}
+
+	var (
+		action string
+		finish func() interface{}
+	)
+	for action = range body {
+		break
+	}
+	switch action {
+	case "startVmInstance":
+		vm.State = "Starting"
+		finish = func() interface{} {
+			vm.State = "Running"
+			return vm
+		}
+	case "stopVmInstance":
+		vm.State = "Stopping"
+		finish = func() interface{} {
+			vm.State = "Stopped"
+			return vm
+		}
+	case "rebootVmInstance":
+		vm.State = "Rebooting"
+		finish = func() interface{} {
+			vm.State = "Running"
+			return vm
+		}
+	case "expungeVmInstance":
+		if vm.State != "Destroyed" {
+			writeError(w, http.StatusBadRequest, "SYS.1007", "vm instance must be destroyed before expunge")
+			return
+		}
+		finish = func() interface{} {
+			delete(s.vms, uuid)
+			s.removeUserTags(uuid)
+			return nil
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "SYS.1006", "unsupported vm instance action "+action)
+		return
+	}
+	s.startJob(w, action, finish)
+}
+
+func (s *Server) checkIPAvailability(w http.ResponseWriter, l3UUID, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vm := range s.vms {
+		for _, nic := range vm.VMNics {
+			if nic.L3NetworkUUID == l3UUID && nic.IP == ip {
+				writeJSON(w, http.StatusOK, map[string]interface{}{
+					"available": false,
+					"reason":    "used by vm " + vm.UUID,
+				})
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"available": true})
+}
+
+func (s *Server) queryResources(w http.ResponseWriter, r *http.Request, collection string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"inventories": filter(s.resources[collection], r.URL.Query()["q"]),
+	})
+}
+
+// startJob must be called with s.mu held.
+func (s *Server) startJob(w http.ResponseWriter, action string, finish func() interface{}) {
+	j := &job{action: action, finish: finish}
+	if scripted := s.scripts[action]; len(scripted) > 0 {
+		j.behavior = scripted[0]
+		s.scripts[action] = scripted[1:]
+	}
+	id := NewUUID()
+	s.jobs[id] = j
+	s.calls = append(s.calls, action)
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"location": s.URL + apiPrefix + jobsPath + "/" + id,
+	})
+}
+
+func (s *Server) pollJob(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.behavior.Outcome == JobNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if j.behavior.Outcome == JobNeverEnds || j.polls < j.behavior.Pending {
+		j.polls++
+		writeJSON(w, http.StatusAccepted, map[string]string{})
+		return
+	}
+
+	if j.behavior.Outcome == JobFail {
+		zstackErr := j.behavior.Error
+		if zstackErr == nil {
+			zstackErr = &common.Error{
+				Code:        "SYS.1006",
+				Description: "an operation failed",
+				Details:     j.action + " failed",
+			}
+		}
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": zstackErr})
+		return
+	}
+
+	if !j.done {
+		j.result = j.finish()
+		j.done = true
+	}
+	if j.result == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"inventory": j.result})
+}
+
+func hashPassword(password string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(password)))
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, errCode, details string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": common.Error{
+			Code:        errCode,
+			Description: http.StatusText(code),
+			Details:     details,
+		},
+	})
+}
+
+func toMap(v interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// filter applies ZStack equality conditions ("field=value", "field!=value"
+// and "field?=a,b") to inventories.
+func filter(inventories []map[string]interface{}, conditions []string) []map[string]interface{} {
+	matched := []map[string]interface{}{}
+	for _, inventory := range inventories {
+		if matchAll(inventory, conditions) {
+			matched = append(matched, inventory)
+		}
+	}
+	return matched
+}
+
+func matchAll(inventory map[string]interface{}, conditions []string) bool {
+	for _, condition := range conditions {
+		var (
+			field, value string
+			negate, in   bool
+		)
+		switch {
+		case strings.Contains(condition, "!?="):
+			parts := strings.SplitN(condition, "!?=", 2)
+			field, value, negate, in = parts[0], parts[1], true, true
+		case strings.Contains(condition, "?="):
+			parts := strings.SplitN(condition, "?=", 2)
+			field, value, in = parts[0], parts[1], true
+		case strings.Contains(condition, "!="):
+			parts := strings.SplitN(condition, "!=", 2)
+			field, value, negate = parts[0], parts[1], true
+		case strings.Contains(condition, "="):
+			parts := strings.SplitN(condition, "=", 2)
+			field, value = parts[0], parts[1]
+		default:
+			continue
+		}
+
+		actual := fmt.Sprint(inventory[field])
+		switch v := inventory[field].(type) {
+		case nil:
+			actual = ""
+		case float64:
+			// JSON numbers decode to float64, compare them as integers
+			actual = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		match := actual == value
+		if in {
+			match = false
+			for _, v := range strings.Split(value, ",") {
+				if actual == v {
+					match = true
+				}
+			}
+		}
+		if match == negate {
+			return false
+		}
+	}
+	return true
+}
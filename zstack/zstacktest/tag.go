@@ -0,0 +1,71 @@
+package zstacktest
+
+import (
+	"net/http"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/tag"
+)
+
+// User tags are kept in the "user-tags" resources, whether they were given
+// to a create request or created later.
+func (s *Server) serveUserTags(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		request := tag.CreateUserTagRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.startJob(w, "createUserTag", func() interface{} {
+			return s.addUserTags(request.Params.ResourceType, request.Params.ResourceUUID, []string{request.Params.Tag})[0]
+		})
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "user-tags")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// addUserTags tags a resource, the caller holds the lock.
+func (s *Server) addUserTags(resourceType, resourceUUID string, tags []string) []*tag.TagInventory {
+	var added []*tag.TagInventory
+	for _, t := range tags {
+		inventory := &tag.TagInventory{
+			ResourceType: resourceType,
+			ResourceUUID: resourceUUID,
+			Tag:          t,
+			Type:         "User",
+		}
+		inventory.UUID = NewUUID()
+		s.resources["user-tags"] = append(s.resources["user-tags"], toMap(inventory))
+		added = append(added, inventory)
+	}
+	return added
+}
+
+// removeUserTags drops the tags of a removed resource, the caller holds the
+// lock.
+func (s *Server) removeUserTags(resourceUUID string) {
+	tags := s.resources["user-tags"][:0]
+	for _, inventory := range s.resources["user-tags"] {
+		if inventory["resourceUuid"] != resourceUUID {
+			tags = append(tags, inventory)
+		}
+	}
+	s.resources["user-tags"] = tags
+}
+
+// UserTags returns the user tags of a resource.
+func (s *Server) UserTags(resourceUUID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tags []string
+	for _, inventory := range s.resources["user-tags"] {
+		if inventory["resourceUuid"] == resourceUUID {
+			tags = append(tags, inventory["tag"].(string))
+		}
+	}
+	return tags
+}
@@ -0,0 +1,111 @@
+package zstacktest
+
+import (
+	"net/http"
+
+	"github.com/cnrancher/docker-machine-driver-zstack/client/instance"
+	"github.com/cnrancher/docker-machine-driver-zstack/client/volume"
+)
+
+// Volumes are kept in the "volumes" resources; a deleted volume has the
+// status "Deleted" until it is expunged.
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "data" && r.Method == http.MethodPost:
+		request := volume.CreateDataVolumeRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		inventory := &volume.VolumeInventory{
+			Name:               request.Params.Name,
+			DiskOfferingUUID:   request.Params.DiskOfferingUUID,
+			PrimaryStorageUUID: request.Params.PrimaryStorageUUID,
+			Size:               request.Params.DiskSize,
+			Type:               "Data",
+			State:              "Enabled",
+			Status:             "Ready",
+		}
+		inventory.UUID = NewUUID()
+		s.startJob(w, "createDataVolume", func() interface{} {
+			s.addUserTags("VolumeVO", inventory.UUID, request.UserTags)
+			s.resources["volumes"] = append(s.resources["volumes"], toMap(inventory))
+			return inventory
+		})
+	case len(parts) == 3 && parts[1] == "vm-instances" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("volumes", parts[0])
+		vm := s.vms[parts[2]]
+		if v == nil || vm == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "volume or vm instance not found")
+			return
+		}
+		s.startJob(w, "attachDataVolumeToVm", func() interface{} {
+			v["vmInstanceUuid"] = vm.UUID
+			attached := &instance.Volume{Type: "Data", VMInstanceUUID: vm.UUID, DeviceID: len(vm.AllVolumes), Status: "Ready"}
+			attached.UUID = parts[0]
+			vm.AllVolumes = append(vm.AllVolumes, attached)
+			return v
+		})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("volumes", parts[0])
+		if v == nil {
+			writeError(w, http.StatusNotFound, "SYS.1001", "volume "+parts[0]+" not found")
+			return
+		}
+		s.startJob(w, "deleteDataVolume", func() interface{} {
+			v["status"] = "Deleted"
+			delete(v, "vmInstanceUuid")
+			return nil
+		})
+	case len(parts) == 3 && parts[0] == "resize" && parts[2] == "actions" && r.Method == http.MethodPut:
+		request := volume.ResizeRootVolumeRequest{}
+		if err := decodeBody(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "SYS.1007", err.Error())
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("volumes", parts[1])
+		if v == nil || v["type"] != "Root" {
+			writeError(w, http.StatusNotFound, "SYS.1001", "root volume "+parts[1]+" not found")
+			return
+		}
+		if size, _ := v["size"].(float64); request.ResizeRootVolume.Size < int64(size) {
+			writeError(w, http.StatusBadRequest, "SYS.1007", "a root volume can not shrink")
+			return
+		}
+		s.startJob(w, "resizeRootVolume", func() interface{} {
+			v["size"] = float64(request.ResizeRootVolume.Size)
+			for _, vm := range s.vms {
+				for _, attached := range vm.AllVolumes {
+					if attached.UUID == parts[1] {
+						attached.Size = request.ResizeRootVolume.Size
+					}
+				}
+			}
+			return v
+		})
+	case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPut:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v := s.findResource("volumes", parts[0])
+		if v == nil || v["status"] != "Deleted" {
+			writeError(w, http.StatusBadRequest, "SYS.1001", "volume "+parts[0]+" is not deleted")
+			return
+		}
+		s.startJob(w, "expungeDataVolume", func() interface{} {
+			s.removeResource("volumes", parts[0])
+			return nil
+		})
+	case r.Method == http.MethodGet:
+		s.queryResources(w, r, "volumes")
+	default:
+		writeError(w, http.StatusNotFound, "SYS.1000", "no API for "+r.Method+" "+r.URL.Path)
+	}
+}